@@ -1,12 +1,20 @@
 package main
-import "regex-engine/internals/regex"
 
-func init() {
+import (
+	"fmt"
+	"os"
+	"regex-engine/internals/regex"
+)
+
+func main() {
 	pattern := "([ab-c]|z)*ab{0,1}c"
 	input := "zzzzzzzzzzzzzzzzzabbc"
 
-	if regex.Match(input, pattern) {
-		// ...
-        {}
+	matched, err := regex.Match(input, pattern)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+
+	fmt.Printf("%s on %s: %t\n", pattern, input, matched)
 }
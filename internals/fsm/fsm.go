@@ -1,189 +1,627 @@
 package fsm
 
 import (
-	"os"
+	"fmt"
 	"regex-engine/internals/parser"
 	"regex-engine/internals/token"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Sentinels returned by readChar outside of the input and for bytes that
+// are not valid UTF-8, kept out of the byte range so that every input byte
+// can be matched literally.
 const (
-	epsilonChar   = '\x00'
-	START_OF_TEXT = 1
-	END_OF_TEXT   = 2
+	START_OF_TEXT = 256
+	END_OF_TEXT   = 257
+	INVALID_UTF8  = 258
 )
 
 type state struct {
-	transition map[byte][]*state
+	transitions []edge
+	epsilon     []*state
+
+	// zero-width assertion that must hold to pass through this state
+	assert token.TokenType
+
+	// capture group whose start (or end, with captureEnd) this state records;
+	// 0 for none
+	capture    int
+	captureEnd bool
+
+	// automaton run on its own before leaving this state; only its first
+	// match is kept, so the matcher never backtracks into it
+	atomic *state
+
+	// lookaround automaton checked at this state without consuming input;
+	// lookWidth bounds how far back a lookbehind can start
+	look      *state
+	lookType  token.TokenType
+	lookWidth int
+
+	// capture group whose last captured text must appear next, in either
+	// case with backrefFold; 0 for none
+	backref     int
+	backrefFold bool
+
+	// capture group tested here: the first epsilon transition is taken if it
+	// has captured something so far, the second otherwise; 0 for none
+	condition int
+
+	// run the automaton of group call, or of the whole pattern for 0, as a
+	// subroutine
+	subroutine bool
+	call       int
+
+	// loop state of an unbounded repeat whose body may match nothing, where
+	// the iteration ending at this state began: the first epsilon transition
+	// starts the next iteration if this one consumed input, and the second
+	// leaves the repeat otherwise, as another would only come back to the
+	// same place; nil for none
+	loop *state
 
 	terminal bool
 	start    bool
+
+	// position of the state in Nfa.states order, which the matcher uses to
+	// index its memo
+	id int
 }
 
-func (s *state) Check(input string, pos int) bool {
-	ch := readChar(input, pos)
+// Nfa is the automaton compiled from a parsed pattern.
+type Nfa struct {
+	start *state
+	end   *state
 
-	if ch == END_OF_TEXT && s.terminal {
-		return true
-	}
+	// number of capture groups, including the whole match as group 0
+	groups int
 
-	if states := s.transition[ch]; len(states) > 0 {
-		nextState := states[0]
-		if nextState.Check(input, pos+1) {
-			return true
-		}
-	}
+	// the pattern has backreferences, so the matcher has to backtrack
+	// without its memo
+	backtrack bool
 
-	for _, s := range s.transition[epsilonChar] {
-		if s.Check(input, pos) {
-			return true
+	// separate automata of the groups the pattern calls as subroutines, by
+	// index; 0 is the whole pattern
+	subroutines map[int]*state
+
+	// number of states, including those of separate automata
+	states int
+
+	// runs of atomic and lookaround automata can share what they find out
+	// about their states: there are some, and no loop can go round without
+	// consuming input, which would make what a state leads to depend on the
+	// path to it
+	share bool
+}
+
+// Check reports whether the whole input is accepted.
+func (n *Nfa) Check(input string) bool {
+	m := newMatcher(n, input, len(input))
+
+	_, ok := m.match(n.start, 0)
+	return ok
+}
+
+// Find returns the capture bounds of the leftmost match anywhere in the
+// input: the start and end of group i are at 2*i and 2*i+1, or -1 if the
+// group did not take part. It returns nil if there is no match.
+func (n *Nfa) Find(input string) []int {
+	m := newMatcher(n, input, -1)
+
+	// matches only start on character boundaries
+	for start := 0; ; {
+		if end, ok := m.match(n.start, start); ok {
+			m.caps[0] = start
+			m.caps[1] = end
+
+			return m.caps
 		}
 
-		if ch == START_OF_TEXT && s.Check(input, pos+1) {
-			return true
+		if start == len(input) {
+			return nil
 		}
-	}
 
-	return false
+		_, size := utf8.DecodeRuneInString(input[start:])
+		start += size
+	}
 }
 
-func ToNfa(ctx *parser.ParseContext) (*state, *state) {
+func ToNfa(ctx *parser.ParseContext) (*Nfa, error) {
 	startState := &state{
-		start:      true,
-		transition: map[byte][]*state{},
+		start: true,
 	}
 
 	endState := &state{
-		terminal:   true,
-		transition: map[byte][]*state{},
+		terminal: true,
+	}
+
+	start, end, err := toNfaTokens(ctx.GetTokens())
+	if err != nil {
+		return nil, err
 	}
 
-	tokens := ctx.GetTokens()
+	startState.epsilon = append(startState.epsilon, start)
+	end.epsilon = append(end.epsilon, endState)
 
-	if len(tokens) == 0 {
-		startState.transition[epsilonChar] = append(startState.transition[epsilonChar], endState)
-		return startState, endState
+	nfa := &Nfa{
+		start:     startState,
+		end:       endState,
+		groups:    len(ctx.GetSubexpNames()),
+		backtrack: ctx.HasBackrefs(),
 	}
 
-	start, end := toNfaToken(tokens[0])
+	if ctx.HasSubroutines() {
+		groups := map[int]token.Token{}
+		collectGroups(ctx.GetTokens(), groups)
 
-	for i := 1; i < len(tokens); i++ {
-		s, e := toNfaToken(tokens[i])
+		nfa.subroutines = map[int]*state{0: startState}
 
-		end.transition[epsilonChar] = append(end.transition[epsilonChar], s)
-		end = e
+		for index, group := range groups {
+			sub, err := toSubNfa(group)
+			if err != nil {
+				return nil, err
+			}
+
+			nfa.subroutines[index] = sub
+		}
 	}
 
-	startState.transition[epsilonChar] = append(startState.transition[epsilonChar], start)
-	end.transition[epsilonChar] = append(end.transition[epsilonChar], endState)
+	nfa.numberStates()
 
-	return startState, endState
+	return nfa, nil
 }
 
-func toNfaToken(tok token.Token) (start, end *state) {
-	startState := &state{
-		transition: map[byte][]*state{},
+// numberStates gives every state reachable from the start or from one of the
+// subroutines an id, counting up from 0, and sets how many there are and
+// whether runs of separate automata can share what they find out.
+func (n *Nfa) numberStates() {
+	separate, emptyLoop := false, false
+
+	seen := map[*state]bool{}
+	pending := []*state{n.start}
+
+	for _, sub := range n.subroutines {
+		pending = append(pending, sub)
 	}
 
-	endState := &state{
-		transition: map[byte][]*state{},
+	for len(pending) > 0 {
+		s := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if s == nil || seen[s] {
+			continue
+		}
+
+		s.id = len(seen)
+		seen[s] = true
+
+		for _, e := range s.transitions {
+			pending = append(pending, e.to)
+		}
+
+		pending = append(pending, s.epsilon...)
+		pending = append(pending, s.atomic, s.look)
+		separate = separate || s.atomic != nil || s.look != nil
+		emptyLoop = emptyLoop || s.loop != nil
+	}
+
+	n.states = len(seen)
+	n.share = separate && !emptyLoop
+}
+
+// reachesEmpty reports whether to can be reached from from through epsilon
+// transitions alone. States that run something of their own may match
+// nothing, so they count as passing through.
+func reachesEmpty(from, to *state) bool {
+	seen := map[*state]bool{}
+	pending := []*state{from}
+
+	for len(pending) > 0 {
+		s := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if s == to {
+			return true
+		}
+
+		if seen[s] {
+			continue
+		}
+
+		seen[s] = true
+		pending = append(pending, s.epsilon...)
+	}
+
+	return false
+}
+
+// collectGroups adds every capture group in toks, however deeply nested, to
+// groups by index.
+func collectGroups(toks []token.Token, groups map[int]token.Token) {
+	for _, tok := range toks {
+		switch value := tok.Value.(type) {
+		case parser.GroupValue:
+			groups[value.Index] = tok
+			collectGroups(value.Tokens, groups)
+		case []token.Token:
+			collectGroups(value, groups)
+		case parser.RepeatValue:
+			collectGroups([]token.Token{value.RepeatToken}, groups)
+		case parser.ConditionalValue:
+			collectGroups([]token.Token{value.Yes, value.No}, groups)
+		}
+	}
+}
+
+// toNfaTokens chains the automata of the tokens one after the other.
+func toNfaTokens(toks []token.Token) (start, end *state, err error) {
+	start = &state{}
+
+	end = start
+
+	for i := 0; i < len(toks); i++ {
+		s, e, err := toNfaToken(toks[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		end.epsilon = append(end.epsilon, s)
+		end = e
+	}
+
+	return start, end, nil
+}
+
+// toSubNfa builds a separate automaton for tok whose end state is terminal,
+// so that the matcher can run it on its own.
+func toSubNfa(tok token.Token) (*state, error) {
+	start, end, err := toNfaToken(tok)
+	if err != nil {
+		return nil, err
 	}
 
+	end.terminal = true
+
+	return start, nil
+}
+
+func toNfaToken(tok token.Token) (start, end *state, err error) {
+	startState := &state{}
+
+	endState := &state{}
+
 	switch tok.Type {
 	case token.LITERAL:
-		ch := tok.Value.(byte)
-		startState.transition[ch] = append(startState.transition[ch], endState)
+		ch := tok.Value.(rune)
+		ranges := []parser.RuneRange{{Lo: ch, Hi: ch}}
+
+		if tok.Flags&token.FLAG_CASE_INSENSITIVE != 0 {
+			ranges = parser.FoldRanges(ranges)
+		}
+
+		addRunes(startState, endState, ranges)
 
 	case token.GROUP, token.UNCAPTURE_GROUP:
-		toks := tok.Value.([]token.Token)
+		var toks []token.Token
 
-		if len(toks) == 0 {
-			startState.transition[epsilonChar] = append(startState.transition[epsilonChar], endState)
-			return startState, endState
+		if group, ok := tok.Value.(parser.GroupValue); ok {
+			toks = group.Tokens
+
+			startState.capture = group.Index
+			endState.capture = group.Index
+			endState.captureEnd = true
+		} else {
+			toks = tok.Value.([]token.Token)
 		}
 
-		for i := 0; i < len(toks); i++ {
-			s, e := toNfaToken(toks[i])
+		if tok.Flags&token.FLAG_LEGACY_GROUPS != 0 {
+			for i := 0; i < len(toks); i++ {
+				s, e, err := toNfaToken(toks[i])
+				if err != nil {
+					return nil, nil, err
+				}
 
-			startState.transition[epsilonChar] = append(startState.transition[epsilonChar], s)
-			e.transition[epsilonChar] = append(e.transition[epsilonChar], endState)
+				startState.epsilon = append(startState.epsilon, s)
+				e.epsilon = append(e.epsilon, endState)
+			}
+
+			return startState, endState, nil
 		}
 
-	case token.OR:
-		tokens := tok.Value.([]token.Token)
+		s, e, err := toNfaTokens(toks)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		startState.epsilon = append(startState.epsilon, s)
+		e.epsilon = append(e.epsilon, endState)
 
-		leftTok := tokens[0]
-		rightTok := tokens[1]
+	case token.ATOMIC_GROUP, token.POSSESSIVE_REPEAT:
+		inner := token.Token{Type: token.UNCAPTURE_GROUP, Value: tok.Value}
+		if tok.Type == token.POSSESSIVE_REPEAT {
+			inner.Type = token.REPEAT
+		}
 
-		leftStart, leftEnd := toNfaToken(leftTok)
-		rightStart, rightEnd := toNfaToken(rightTok)
+		sub, err := toSubNfa(inner)
+		if err != nil {
+			return nil, nil, err
+		}
 
-		startState.transition[epsilonChar] = append(startState.transition[epsilonChar], leftStart, rightStart)
+		startState.atomic = sub
+		startState.epsilon = append(startState.epsilon, endState)
 
-		leftEnd.transition[epsilonChar] = append(leftEnd.transition[epsilonChar], endState)
-		rightEnd.transition[epsilonChar] = append(rightEnd.transition[epsilonChar], endState)
+	case token.OR:
+		branches := tok.Value.([]token.Token)
+
+		for _, branch := range branches {
+			s, e, err := toNfaToken(branch)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			startState.epsilon = append(startState.epsilon, s)
+			e.epsilon = append(e.epsilon, endState)
+		}
 
 	case token.BRACKET:
-		literals := tok.Value.(map[byte]bool)
+		bracket := tok.Value.(parser.BracketValue)
+		ranges := bracket.Ranges
+
+		// fold before negating, so that (?i)[^a] leaves out 'A' as well
+		if tok.Flags&token.FLAG_CASE_INSENSITIVE != 0 {
+			ranges = parser.FoldRanges(ranges)
+		}
 
-		for l := range literals {
-			startState.transition[l] = append(startState.transition[l], endState)
+		if bracket.Negated {
+			ranges = parser.NegateRanges(ranges)
 		}
 
+		addRunes(startState, endState, ranges)
+
+	case token.ANY:
+		ranges := []parser.RuneRange{{Lo: 0, Hi: unicode.MaxRune}}
+
+		if tok.Flags&token.FLAG_DOT_NL == 0 {
+			ranges = []parser.RuneRange{{Lo: 0, Hi: '\n' - 1}, {Lo: '\n' + 1, Hi: unicode.MaxRune}}
+		}
+
+		addRunes(startState, endState, ranges)
+
+	case token.LOOKAHEAD, token.NEGATIVE_LOOKAHEAD, token.LOOKBEHIND, token.NEGATIVE_LOOKBEHIND:
+		group := token.Token{Type: token.UNCAPTURE_GROUP, Value: tok.Value}
+
+		sub, err := toSubNfa(group)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		startState.look = sub
+		startState.lookType = tok.Type
+		startState.lookWidth = maxWidth(group)
+		startState.epsilon = append(startState.epsilon, endState)
+
+	case token.BACKREFERENCE:
+		startState.backref = tok.Value.(int)
+		startState.backrefFold = tok.Flags&token.FLAG_CASE_INSENSITIVE != 0
+		startState.epsilon = append(startState.epsilon, endState)
+
+	case token.CONDITIONAL:
+		conditional := tok.Value.(parser.ConditionalValue)
+		startState.condition = conditional.Index
+
+		for _, branch := range []token.Token{conditional.Yes, conditional.No} {
+			s, e, err := toNfaToken(branch)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			startState.epsilon = append(startState.epsilon, s)
+			e.epsilon = append(e.epsilon, endState)
+		}
+
+	case token.SUBROUTINE:
+		startState.subroutine = true
+		startState.call = tok.Value.(int)
+		startState.epsilon = append(startState.epsilon, endState)
+
+	case token.BEGIN_TEXT, token.END_TEXT, token.BEGIN_LINE, token.END_LINE,
+		token.WORD_BOUNDARY, token.NOT_WORD_BOUNDARY:
+		startState.assert = tok.Type
+		startState.epsilon = append(startState.epsilon, endState)
+
 	case token.REPEAT:
 		repeat := tok.Value.(parser.RepeatValue)
 
-		if repeat.Min == 0 {
-			startState.transition[epsilonChar] = append(startState.transition[epsilonChar], endState)
+		// (?U) swaps the meaning of a*? and a*
+		lazy := repeat.Lazy != (tok.Flags&token.FLAG_UNGREEDY != 0)
+
+		// choose adds the option to run another copy or to leave the repeat,
+		// preferring one or the other depending on greediness
+		choose := func(from, copyStart *state) {
+			if lazy {
+				from.epsilon = append(from.epsilon, endState, copyStart)
+			} else {
+				from.epsilon = append(from.epsilon, copyStart, endState)
+			}
 		}
 
-		start, end := toNfaToken(repeat.RepeatToken)
+		end := startState
 
-		startState.transition[epsilonChar] = append(startState.transition[epsilonChar], start)
+		for i := 0; i < repeat.Min; i++ {
+			s, e, err := toNfaToken(repeat.RepeatToken)
+			if err != nil {
+				return nil, nil, err
+			}
 
-		var copyCount int
+			end.epsilon = append(end.epsilon, s)
+			end = e
+		}
 
 		if repeat.Max == parser.INFINITY {
-			if repeat.Min == 0 {
-				copyCount = 1
-			} else {
-				copyCount = repeat.Min
+			loop := &state{}
+
+			s, e, err := toNfaToken(repeat.RepeatToken)
+			if err != nil {
+				return nil, nil, err
 			}
-		} else {
-			copyCount = repeat.Max
-		}
 
-		for i := 2; i <= copyCount; i++ {
-			s, e := toNfaToken(repeat.RepeatToken)
+			end.epsilon = append(end.epsilon, loop)
+			choose(loop, s)
+
+			if !reachesEmpty(s, e) {
+				e.epsilon = append(e.epsilon, loop)
+				return startState, endState, nil
+			}
 
-			end.transition[epsilonChar] = append(end.transition[epsilonChar], s)
+			// iterations take turns between two copies of a body that may
+			// match nothing, so that one starting where the last one ended
+			// does not run into the states the last one is still on there
+			other := &state{}
 
-			if i > repeat.Min {
-				s.transition[epsilonChar] = append(s.transition[epsilonChar], endState)
+			s2, e2, err := toNfaToken(repeat.RepeatToken)
+			if err != nil {
+				return nil, nil, err
 			}
 
-			start = s
-            end = e
+			choose(other, s2)
+
+			check := &state{loop: loop}
+			check.epsilon = append(check.epsilon, other, endState)
+			e.epsilon = append(e.epsilon, check)
+
+			check2 := &state{loop: other}
+			check2.epsilon = append(check2.epsilon, loop, endState)
+			e2.epsilon = append(e2.epsilon, check2)
+
+			return startState, endState, nil
 		}
 
-		end.transition[epsilonChar] = append(end.transition[epsilonChar], endState)
+		for i := repeat.Min; i < repeat.Max; i++ {
+			s, e, err := toNfaToken(repeat.RepeatToken)
+			if err != nil {
+				return nil, nil, err
+			}
 
-		if repeat.Max == parser.INFINITY {
-			endState.transition[epsilonChar] = append(endState.transition[epsilonChar], start)
+			choose(end, s)
+			end = e
 		}
 
+		end.epsilon = append(end.epsilon, endState)
+
 	default:
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("fsm: unknown token type %q", tok.Type)
 	}
 
-	return startState, endState
+	return startState, endState, nil
 }
 
-func readChar(input string, pos int) byte {
+// maxWidth returns the most bytes tok can match, or parser.INFINITY if there
+// is no bound.
+func maxWidth(tok token.Token) int {
+	switch tok.Type {
+	case token.LITERAL:
+		ch := tok.Value.(rune)
+		width := utf8.RuneLen(ch)
+
+		// a case form can take more bytes, as the Kelvin sign does for 'k'
+		if tok.Flags&token.FLAG_CASE_INSENSITIVE != 0 {
+			for f := unicode.SimpleFold(ch); f != ch; f = unicode.SimpleFold(f) {
+				width = max(width, utf8.RuneLen(f))
+			}
+		}
+
+		return width
+
+	case token.BRACKET, token.ANY:
+		return utf8.UTFMax
+
+	case token.GROUP, token.UNCAPTURE_GROUP, token.ATOMIC_GROUP:
+		toks, ok := tok.Value.([]token.Token)
+		if !ok {
+			toks = tok.Value.(parser.GroupValue).Tokens
+		}
+
+		width := 0
+
+		for _, t := range toks {
+			w := maxWidth(t)
+			if w == parser.INFINITY {
+				return parser.INFINITY
+			}
+
+			width += w
+		}
+
+		return width
+
+	case token.OR:
+		width := 0
+
+		for _, branch := range tok.Value.([]token.Token) {
+			w := maxWidth(branch)
+			if w == parser.INFINITY {
+				return parser.INFINITY
+			}
+
+			width = max(width, w)
+		}
+
+		return width
+
+	case token.REPEAT, token.POSSESSIVE_REPEAT:
+		repeat := tok.Value.(parser.RepeatValue)
+
+		w := maxWidth(repeat.RepeatToken)
+		if w == 0 {
+			return 0
+		}
+
+		if w == parser.INFINITY || repeat.Max == parser.INFINITY {
+			return parser.INFINITY
+		}
+
+		return w * repeat.Max
+
+	case token.CONDITIONAL:
+		conditional := tok.Value.(parser.ConditionalValue)
+
+		yes, no := maxWidth(conditional.Yes), maxWidth(conditional.No)
+		if yes == parser.INFINITY || no == parser.INFINITY {
+			return parser.INFINITY
+		}
+
+		return max(yes, no)
+
+	case token.BACKREFERENCE, token.SUBROUTINE:
+		return parser.INFINITY
+
+	default: // zero-width assertions
+		return 0
+	}
+}
+
+// readChar returns the byte at pos, or INVALID_UTF8 if it is not part of a
+// valid UTF-8 sequence, so that every invalid byte stands for one U+FFFD.
+func readChar(input string, pos int) int {
 	if pos >= len(input) {
 		return END_OF_TEXT
 	} else if pos < 0 {
 		return START_OF_TEXT
+	} else if input[pos] < utf8.RuneSelf || inSequence(input, pos) {
+		return int(input[pos])
 	} else {
-		return input[pos]
+		return INVALID_UTF8
+	}
+}
+
+// inSequence reports whether the byte at pos belongs to a valid UTF-8
+// sequence of several bytes.
+func inSequence(input string, pos int) bool {
+	for start := pos; start >= 0 && start > pos-utf8.UTFMax; start-- {
+		if _, size := utf8.DecodeRuneInString(input[start:]); size > 1 && start+size > pos {
+			return true
+		}
 	}
+
+	return false
 }
@@ -0,0 +1,663 @@
+package fsm
+
+import (
+	"regex-engine/internals/parser"
+	"regex-engine/internals/token"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MAX_MEMO_BITS bounds the size of the bitset a matcher remembers visited
+// states in; larger automata or inputs fall back to a map. Atomic groups,
+// lookarounds and subroutine calls run many short matchers of their own,
+// which get at most MAX_SUB_MEMO_BITS each.
+const (
+	MAX_MEMO_BITS     = 1 << 26
+	MAX_SUB_MEMO_BITS = 1 << 16
+)
+
+// MAX_CALL_DEPTH bounds how deeply subroutine calls can nest; a match that
+// needs more fails. Outside backtrack mode a call that fails this way is
+// remembered like any other, so it fails at that position however deep the
+// next attempt starts.
+const MAX_CALL_DEPTH = 1000
+
+type visit struct {
+	state *state
+	pos   int
+}
+
+// memo is the set of (state, position) pairs a matcher has visited, kept in
+// a bitset indexed by state id and position when that is small enough and
+// in a map otherwise.
+type memo struct {
+	bits  []uint64
+	lo    int
+	width int
+
+	pairs map[visit]bool
+}
+
+// newMemo returns a memo for an automaton with the given number of states
+// run over the positions from lo to hi, using a bitset if it takes at most
+// limit bits.
+func newMemo(states, lo, hi, limit int) *memo {
+	width := hi - lo + 1
+	if states == 0 || width <= 0 || states > limit/width {
+		return &memo{pairs: map[visit]bool{}}
+	}
+
+	return &memo{bits: make([]uint64, (states*width+63)/64), lo: lo, width: width}
+}
+
+func (v *memo) has(key visit) bool {
+	if v.bits == nil {
+		return v.pairs[key]
+	}
+
+	i := key.state.id*v.width + key.pos - v.lo
+	return v.bits[i/64]&(1<<(i%64)) != 0
+}
+
+func (v *memo) add(key visit) {
+	if v.bits == nil {
+		v.pairs[key] = true
+		return
+	}
+
+	i := key.state.id*v.width + key.pos - v.lo
+	v.bits[i/64] |= 1 << (i % 64)
+}
+
+func (v *memo) remove(key visit) {
+	if v.bits == nil {
+		delete(v.pairs, key)
+		return
+	}
+
+	i := key.state.id*v.width + key.pos - v.lo
+	v.bits[i/64] &^= 1 << (i % 64)
+}
+
+// outcome is how a separate automaton run from some position turned out:
+// where its first match ends, if any, and the captures it set there as
+// slot and value pairs.
+type outcome struct {
+	end  int
+	ok   bool
+	caps []int
+}
+
+// matcher walks the automaton depth first, trying transitions in the order
+// they were added. Since the outcome from a state only depends on the input
+// position, every (state, position) pair is explored at most once.
+//
+// The same goes for atomic groups, lookarounds and subroutine calls, whose
+// outcomes are kept by state and position so that each runs at most once
+// per position.
+//
+// Backreferences break that: the outcome also depends on what the groups
+// captured so far. In backtrack mode a pair is only skipped while it is on
+// the current path, which stops empty loops but makes the search exponential
+// in the worst case.
+type matcher struct {
+	input string
+
+	// only accept at this position, or anywhere if negative
+	endAt int
+
+	visited   *memo
+	backtrack bool
+
+	// number of states in the automata, which sizes the memos
+	states int
+
+	subroutines map[int]*state
+
+	// subroutine calls in progress, shared by every nested matcher; a call
+	// fails if it would enter the same subroutine again at the same position
+	// without consuming input
+	calls map[visit]bool
+
+	// how many calls that guard has turned down, shared by every nested
+	// matcher; an outcome found while it grew depends on the calls in
+	// progress, so it is not kept
+	rejected *int
+
+	// outcomes of atomic groups and lookarounds by state and position, and
+	// of calls by subroutine and position, shared by every nested matcher;
+	// empty in backtrack mode
+	outcomes map[visit]outcome
+	returns  map[visit]outcome
+
+	// what earlier runs of separate automata that may end anywhere found
+	// out: the states that failed, and where the states on an accepted path
+	// lead. Shared by the nested matchers of such runs when Nfa.share allows
+	// it, outside backtrack mode and in patterns without subroutine calls,
+	// whose guard makes outcomes depend on the calls in progress; nil
+	// otherwise.
+	failed *memo
+	ends   map[visit]int
+
+	// capture bounds along the current path, see Nfa.Find
+	caps []int
+}
+
+func newMatcher(n *Nfa, input string, endAt int) *matcher {
+	m := &matcher{
+		input:       input,
+		endAt:       endAt,
+		visited:     newMemo(n.states, 0, len(input), MAX_MEMO_BITS),
+		backtrack:   n.backtrack,
+		states:      n.states,
+		subroutines: n.subroutines,
+		calls:       map[visit]bool{},
+		rejected:    new(int),
+		outcomes:    map[visit]outcome{},
+		returns:     map[visit]outcome{},
+		caps:        newCaps(2 * n.groups),
+	}
+
+	if n.share && !n.backtrack && n.subroutines == nil {
+		m.failed = newMemo(n.states, 0, len(input), MAX_MEMO_BITS)
+		m.ends = map[visit]int{}
+	}
+
+	return m
+}
+
+// newCaps returns n capture bounds, none of them set.
+func newCaps(n int) []int {
+	caps := make([]int, n)
+	for i := range caps {
+		caps[i] = -1
+	}
+
+	return caps
+}
+
+// frame is a state on the current path along with the choices left to try
+// from it.
+type frame struct {
+	visit
+
+	// next choice to try and the end of the choices, counting the
+	// transitions out of the state and then its epsilon transitions
+	next, last int
+
+	// position the epsilon transitions leave from, past the text a
+	// backreference, atomic group or subroutine call consumed
+	from int
+
+	// capture slot set on entering the state, restored to old on leaving
+	// it; -1 for none
+	slot, old int
+
+	// capture bounds to restore on leaving an atomic group or a lookaround
+	saved []int
+}
+
+// match returns the end position of the first accepted path from s at pos.
+// The path is kept on a stack of its own rather than the goroutine's, so the
+// length of the input is not limited by the call stack.
+func (m *matcher) match(s *state, pos int) (int, bool) {
+	var stack []frame
+
+	if end, ok := m.enter(&stack, s, pos); ok {
+		m.accepted(stack, end)
+		return end, true
+	}
+
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+
+		if f.next == f.last {
+			m.leave(f)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		choice := f.next
+		f.next++
+
+		next, at := (*state)(nil), f.from
+
+		if choice < len(f.state.transitions) {
+			e := f.state.transitions[choice]
+			if ch := readChar(m.input, f.pos); ch < e.lo || e.hi < ch {
+				continue
+			}
+
+			next, at = e.to, f.pos+1
+		} else {
+			next = f.state.epsilon[choice-len(f.state.transitions)]
+		}
+
+		// a frame with nothing left to try or undo can go before its last
+		// choice is entered, which keeps long runs of input off the stack
+		if f.next == f.last && f.slot < 0 && f.saved == nil && !m.backtrack {
+			stack = stack[:len(stack)-1]
+		}
+
+		if end, ok := m.enter(&stack, next, at); ok {
+			m.accepted(stack, end)
+			return end, true
+		}
+	}
+
+	return 0, false
+}
+
+// accepted records that the states on the path lead to end, for later runs
+// to reuse. It stops at the last capture on the path, since reaching end
+// from further back also sets that capture.
+func (m *matcher) accepted(stack []frame, end int) {
+	if m.ends == nil {
+		return
+	}
+
+	for i := len(stack) - 1; i >= 0 && stack[i].slot < 0; i-- {
+		m.ends[stack[i].visit] = end
+	}
+}
+
+// enter moves onto s at pos and pushes its frame, or reports the end of the
+// match if s accepts there. Nothing is pushed if the path fails at s.
+func (m *matcher) enter(stack *[]frame, s *state, pos int) (int, bool) {
+	key := visit{state: s, pos: pos}
+
+	// the check at the end of an iteration only decides where to go next,
+	// and its choice depends on the path
+	if s.loop == nil && m.visited.has(key) {
+		return 0, false
+	}
+
+	if m.ends != nil {
+		if end, ok := m.ends[key]; ok {
+			return end, true
+		}
+
+		if m.failed.has(key) {
+			return 0, false
+		}
+	}
+
+	if s.loop == nil {
+		m.visited.add(key)
+	}
+
+	f := frame{visit: key, from: pos, slot: -1}
+
+	if s.assert != "" && !m.assertion(s.assert, pos) {
+		m.leave(&f)
+		return 0, false
+	}
+
+	if s.capture != 0 {
+		f.slot = 2 * s.capture
+		if s.captureEnd {
+			f.slot++
+		}
+
+		f.old = m.caps[f.slot]
+		m.caps[f.slot] = pos
+	}
+
+	if s.terminal && (m.endAt < 0 || pos == m.endAt) {
+		return pos, true
+	}
+
+	if !m.step(&f) {
+		m.leave(&f)
+		return 0, false
+	}
+
+	*stack = append(*stack, f)
+
+	return 0, false
+}
+
+// leave undoes what entering the state of f changed once every path through
+// it has failed.
+func (m *matcher) leave(f *frame) {
+	if f.saved != nil {
+		copy(m.caps, f.saved)
+	}
+
+	if f.slot >= 0 {
+		m.caps[f.slot] = f.old
+	}
+
+	if m.backtrack {
+		m.visited.remove(f.visit)
+	}
+
+	if m.failed != nil {
+		m.failed.add(f.visit)
+	}
+}
+
+// step sets up the choices out of the state of f, running whatever the
+// state has to check first. It reports false if the state fails outright.
+func (m *matcher) step(f *frame) bool {
+	s := f.state
+
+	f.next = len(s.transitions)
+	f.last = len(s.transitions) + len(s.epsilon)
+
+	switch {
+	case s.atomic != nil:
+		return m.stepAtomic(f)
+	case s.look != nil:
+		return m.stepLook(f)
+	case s.backref != 0:
+		return m.stepBackref(f)
+	case s.condition != 0:
+		return m.stepCondition(f)
+	case s.subroutine:
+		return m.stepCall(f)
+	case s.loop != nil:
+		return m.stepLoop(f)
+	}
+
+	// follow the transitions out of s in priority order
+	f.next = 0
+
+	return true
+}
+
+// stepAtomic commits to the first match of the atomic automaton before
+// following the transitions out of the state.
+func (m *matcher) stepAtomic(f *frame) bool {
+	f.saved = append([]int(nil), m.caps...)
+
+	o := m.remember(m.outcomes, f.visit, func() outcome {
+		return m.runSub(f.state.atomic, f.pos, -1)
+	})
+	f.from = o.end
+
+	return o.ok
+}
+
+// stepLook checks the lookaround automaton without consuming input. A
+// lookbehind must match text ending at the current position, so it is tried
+// from every start within its widest possible match.
+func (m *matcher) stepLook(f *frame) bool {
+	s, pos := f.state, f.pos
+	f.saved = append([]int(nil), m.caps...)
+
+	o := m.remember(m.outcomes, f.visit, func() outcome {
+		switch s.lookType {
+		case token.LOOKAHEAD, token.NEGATIVE_LOOKAHEAD:
+			return m.runSub(s.look, pos, -1)
+		}
+
+		lowest := 0
+		if s.lookWidth != parser.INFINITY && pos-s.lookWidth > 0 {
+			lowest = pos - s.lookWidth
+		}
+
+		for start := pos; start >= lowest; start-- {
+			if o := m.runSub(s.look, start, pos); o.ok {
+				return o
+			}
+		}
+
+		return outcome{}
+	})
+
+	negative := s.lookType == token.NEGATIVE_LOOKAHEAD || s.lookType == token.NEGATIVE_LOOKBEHIND
+
+	// a negative lookaround never sets captures
+	if negative {
+		copy(m.caps, f.saved)
+	}
+
+	return o.ok != negative
+}
+
+// stepBackref matches the text last captured by the referenced group again.
+// It fails if the group has not taken part in the match yet.
+func (m *matcher) stepBackref(f *frame) bool {
+	s, pos := f.state, f.pos
+
+	start, end := m.caps[2*s.backref], m.caps[2*s.backref+1]
+	if start < 0 || end < start {
+		return false
+	}
+
+	captured := m.input[start:end]
+
+	if s.backrefFold {
+		n, ok := foldPrefix(m.input[pos:], captured)
+		f.from = pos + n
+
+		return ok
+	}
+
+	if !strings.HasPrefix(m.input[pos:], captured) {
+		return false
+	}
+
+	f.from = pos + len(captured)
+
+	return true
+}
+
+// foldPrefix reports whether text starts with captured in either case, rune
+// by rune, and how many bytes of text that takes: a case form can be longer
+// or shorter, as the Kelvin sign is for 'k'. Bytes that are not valid UTF-8
+// only match themselves.
+func foldPrefix(text, captured string) (int, bool) {
+	n := 0
+
+	for i := 0; i < len(captured); {
+		if n == len(text) {
+			return 0, false
+		}
+
+		want, wantSize := utf8.DecodeRuneInString(captured[i:])
+		got, gotSize := utf8.DecodeRuneInString(text[n:])
+
+		if want == utf8.RuneError && wantSize == 1 || got == utf8.RuneError && gotSize == 1 {
+			if wantSize != gotSize || captured[i] != text[n] {
+				return 0, false
+			}
+		} else if !sameFold(got, want) {
+			return 0, false
+		}
+
+		i += wantSize
+		n += gotSize
+	}
+
+	return n, true
+}
+
+// sameFold reports whether a and b are case forms of each other, following
+// the orbit of unicode.SimpleFold.
+func sameFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stepCondition takes the yes branch of a conditional if its group has
+// captured something on the current path and the no branch otherwise.
+func (m *matcher) stepCondition(f *frame) bool {
+	branch := 1
+	if m.caps[2*f.state.condition+1] >= 0 {
+		branch = 0
+	}
+
+	f.next += branch
+	f.last = f.next + 1
+
+	return true
+}
+
+// stepLoop ends an unbounded repeat after an iteration that consumed no
+// input, and goes round again otherwise. The loop state is on the path at
+// the same position exactly when the iteration was empty, since positions
+// never go back along a path; outside backtrack mode it may also have
+// failed there already, in which case leaving fails as well.
+func (m *matcher) stepLoop(f *frame) bool {
+	branch := 0
+	if m.visited.has(visit{state: f.state.loop, pos: f.pos}) {
+		branch = 1
+	}
+
+	f.next += branch
+	f.last = f.next + 1
+
+	return true
+}
+
+// runSub runs a separate automaton from pos. Outside backtrack mode nothing
+// reads the captures, so it starts without any and the outcome lists those
+// it set; otherwise it shares the capture bounds and sets them in place.
+func (m *matcher) runSub(start *state, pos, endAt int) outcome {
+	if m.backtrack {
+		end, ok := m.sub(pos, endAt, m.caps).match(start, pos)
+		return outcome{end: end, ok: ok}
+	}
+
+	sub := m.sub(pos, endAt, newCaps(len(m.caps)))
+	o := outcome{}
+	o.end, o.ok = sub.match(start, pos)
+
+	if o.ok {
+		for slot, c := range sub.caps {
+			if c >= 0 {
+				o.caps = append(o.caps, slot, c)
+			}
+		}
+	}
+
+	return o
+}
+
+// remember returns the outcome of run for key, running it only the first time
+// outside backtrack mode, and sets the captures it made.
+func (m *matcher) remember(known map[visit]outcome, key visit, run func() outcome) outcome {
+	o, ok := known[key]
+
+	if !ok {
+		rejected := *m.rejected
+		o = run()
+
+		if !m.backtrack && *m.rejected == rejected {
+			known[key] = o
+		}
+	}
+
+	m.setCaps(o)
+
+	return o
+}
+
+// setCaps sets the captures listed in o.
+func (m *matcher) setCaps(o outcome) {
+	for i := 0; i < len(o.caps); i += 2 {
+		m.caps[o.caps[i]] = o.caps[i+1]
+	}
+}
+
+// stepCall runs a subroutine on its own, like an atomic group, and then
+// follows the transitions out of the state. Captures set inside the call
+// are discarded when it returns.
+func (m *matcher) stepCall(f *frame) bool {
+	key := visit{state: m.subroutines[f.state.call], pos: f.pos}
+
+	o := m.remember(m.returns, key, func() outcome {
+		if m.calls[key] {
+			*m.rejected++
+			return outcome{}
+		}
+
+		if len(m.calls) >= MAX_CALL_DEPTH {
+			return outcome{}
+		}
+
+		caps := newCaps(len(m.caps))
+		if m.backtrack {
+			caps = append([]int(nil), m.caps...)
+		}
+
+		m.calls[key] = true
+		end, ok := m.sub(f.pos, -1, caps).match(key.state, f.pos)
+		delete(m.calls, key)
+
+		return outcome{end: end, ok: ok}
+	})
+	f.from = o.end
+
+	return o.ok
+}
+
+// sub returns a matcher for a separate automaton run on the same input from
+// pos, which never goes past endAt when that is set.
+func (m *matcher) sub(pos, endAt int, caps []int) *matcher {
+	hi := len(m.input)
+	if endAt >= 0 {
+		hi = endAt
+	}
+
+	sub := &matcher{
+		input:       m.input,
+		endAt:       endAt,
+		visited:     newMemo(m.states, pos, hi, MAX_SUB_MEMO_BITS),
+		backtrack:   m.backtrack,
+		states:      m.states,
+		subroutines: m.subroutines,
+		calls:       m.calls,
+		rejected:    m.rejected,
+		outcomes:    m.outcomes,
+		returns:     m.returns,
+		caps:        caps,
+	}
+
+	// a lookbehind must end at a given position, so what it finds out only
+	// holds for that position
+	if endAt < 0 {
+		sub.failed, sub.ends = m.failed, m.ends
+	}
+
+	return sub
+}
+
+// assertion reports whether a zero-width assertion holds at pos.
+func (m *matcher) assertion(assert token.TokenType, pos int) bool {
+	switch assert {
+	case token.BEGIN_TEXT:
+		return readChar(m.input, pos-1) == START_OF_TEXT
+	case token.END_TEXT:
+		return readChar(m.input, pos) == END_OF_TEXT
+	case token.BEGIN_LINE:
+		prev := readChar(m.input, pos-1)
+		return prev == START_OF_TEXT || prev == '\n'
+	case token.END_LINE:
+		next := readChar(m.input, pos)
+		return next == END_OF_TEXT || next == '\n'
+	case token.WORD_BOUNDARY:
+		return isWordChar(readChar(m.input, pos-1)) != isWordChar(readChar(m.input, pos))
+	case token.NOT_WORD_BOUNDARY:
+		return isWordChar(readChar(m.input, pos-1)) == isWordChar(readChar(m.input, pos))
+	default:
+		return false
+	}
+}
+
+// isWordChar reports whether ch is in \w; the text sentinels are not.
+func isWordChar(ch int) bool {
+	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') || ch == '_'
+}
@@ -0,0 +1,133 @@
+package fsm
+
+import (
+	"regex-engine/internals/parser"
+	"unicode/utf8"
+)
+
+// edge is a transition taken on any byte from lo to hi, which are ints so
+// that INVALID_UTF8 can be matched as well.
+type edge struct {
+	lo, hi int
+	to     *state
+}
+
+type byteRange struct {
+	lo, hi byte
+}
+
+// addRunes adds transitions from start to end over the UTF-8 encoding of every
+// rune in the normalized ranges. Sequences with a common prefix share their
+// states, and a byte of invalid UTF-8 is matched wherever U+FFFD is.
+func addRunes(start, end *state, ranges []parser.RuneRange) {
+	for _, r := range ranges {
+		for _, seq := range utf8Sequences(r.Lo, r.Hi) {
+			from := start
+
+			for _, b := range seq[:len(seq)-1] {
+				from = from.next(b, end)
+			}
+
+			last := seq[len(seq)-1]
+			from.transitions = append(from.transitions, edge{lo: int(last.lo), hi: int(last.hi), to: end})
+		}
+
+		if r.Lo <= utf8.RuneError && utf8.RuneError <= r.Hi {
+			start.transitions = append(start.transitions, edge{lo: INVALID_UTF8, hi: INVALID_UTF8, to: end})
+		}
+	}
+}
+
+// next returns the state reached from s over exactly the bytes in b on the
+// way to end, adding it if needed.
+func (s *state) next(b byteRange, end *state) *state {
+	for _, e := range s.transitions {
+		if e.lo == int(b.lo) && e.hi == int(b.hi) && e.to != end {
+			return e.to
+		}
+	}
+
+	to := &state{}
+	s.transitions = append(s.transitions, edge{lo: int(b.lo), hi: int(b.hi), to: to})
+
+	return to
+}
+
+// utf8Sequences splits the runes from lo to hi into sequences of byte ranges,
+// such that the encoding of every rune is matched by exactly one sequence.
+// Surrogates, which have no UTF-8 encoding, are left out.
+func utf8Sequences(lo, hi rune) [][]byteRange {
+	var seqs [][]byteRange
+
+	todo := [][2]rune{{lo, hi}}
+
+	for len(todo) > 0 {
+		lo, hi := todo[len(todo)-1][0], todo[len(todo)-1][1]
+		todo = todo[:len(todo)-1]
+
+	split:
+		for lo <= hi {
+			if lo <= 0xdfff && hi >= 0xd800 { // surrogates
+				if hi > 0xdfff {
+					todo = append(todo, [2]rune{0xe000, hi})
+				}
+
+				if lo >= 0xd800 {
+					break
+				}
+
+				hi = 0xd7ff
+			}
+
+			// runes whose encodings differ in length
+			for _, max := range []rune{0x7f, 0x7ff, 0xffff} {
+				if lo <= max && max < hi {
+					todo = append(todo, [2]rune{max + 1, hi})
+					hi = max
+					continue split
+				}
+			}
+
+			if hi < utf8.RuneSelf {
+				seqs = append(seqs, []byteRange{{byte(lo), byte(hi)}})
+				break
+			}
+
+			// runes that differ before their last i continuation bytes must
+			// cover those bytes entirely
+			for i := 1; i < utf8.UTFMax; i++ {
+				mask := rune(1)<<(6*i) - 1
+
+				if lo&^mask != hi&^mask {
+					if lo&mask != 0 {
+						todo = append(todo, [2]rune{(lo | mask) + 1, hi})
+						hi = lo | mask
+						continue split
+					}
+
+					if hi&mask != mask {
+						todo = append(todo, [2]rune{hi &^ mask, hi})
+						hi = hi&^mask - 1
+						continue split
+					}
+				}
+			}
+
+			var from, to [utf8.UTFMax]byte
+
+			n := utf8.EncodeRune(from[:], lo)
+			utf8.EncodeRune(to[:], hi)
+
+			seq := make([]byteRange, n)
+			for i := range seq {
+				seq[i] = byteRange{from[i], to[i]}
+			}
+
+			seqs = append(seqs, seq)
+
+			break
+		}
+	}
+
+	return seqs
+}
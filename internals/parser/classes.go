@@ -0,0 +1,183 @@
+package parser
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// perlClass returns the bracket for the shorthand class \d, \w or \s, or the
+// negation of it for \D, \W and \S.
+func perlClass(letter byte) (BracketValue, bool) {
+	var in func(c byte) bool
+
+	switch letter {
+	case 'd', 'D':
+		in = isDigit
+	case 'w', 'W':
+		in = isWordChar
+	case 's', 'S':
+		in = isSpace
+	default:
+		return BracketValue{}, false
+	}
+
+	return BracketValue{
+		Ranges:  asciiRanges(in),
+		Negated: 'A' <= letter && letter <= 'Z',
+	}, true
+}
+
+var posixClasses = map[string]func(c byte) bool{
+	"alnum":  func(c byte) bool { return isDigit(c) || isAlpha(c) },
+	"alpha":  isAlpha,
+	"ascii":  func(c byte) bool { return c <= 0x7f },
+	"blank":  func(c byte) bool { return c == ' ' || c == '\t' },
+	"cntrl":  func(c byte) bool { return c < ' ' || c == 0x7f },
+	"digit":  isDigit,
+	"graph":  func(c byte) bool { return '!' <= c && c <= '~' },
+	"lower":  func(c byte) bool { return 'a' <= c && c <= 'z' },
+	"print":  func(c byte) bool { return ' ' <= c && c <= '~' },
+	"punct":  func(c byte) bool { return '!' <= c && c <= '~' && !isDigit(c) && !isAlpha(c) },
+	"space":  isSpace,
+	"upper":  func(c byte) bool { return 'A' <= c && c <= 'Z' },
+	"word":   isWordChar,
+	"xdigit": func(c byte) bool { return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F') },
+}
+
+// posixClass returns the bracket for a POSIX class name such as "alpha", or
+// its negation for "^alpha".
+func posixClass(name string) (BracketValue, bool) {
+	in, ok := posixClasses[strings.TrimPrefix(name, "^")]
+	if !ok {
+		return BracketValue{}, false
+	}
+
+	return BracketValue{
+		Ranges:  asciiRanges(in),
+		Negated: strings.HasPrefix(name, "^"),
+	}, true
+}
+
+// unicodeClass parses the property class \pL, \p{Greek}, \PL or \p{^Greek}
+// whose backslash is at pos and returns it along with the position of its
+// last byte. Properties are the general categories and scripts of package
+// unicode, or Any.
+func unicodeClass(pattern string, pos int) (BracketValue, int, *ParseError) {
+	class := BracketValue{Negated: pattern[pos+1] == 'P'}
+
+	if pos+2 >= len(pattern) {
+		return class, pos, newError(UNKNOWN_PROPERTY, pattern, pos, len(pattern))
+	}
+
+	name, end := pattern[pos+2:pos+3], pos+2 // \pL
+
+	if pattern[pos+2] == '{' { // \p{Greek}
+		length := strings.IndexByte(pattern[pos+3:], '}')
+		if length == -1 {
+			return class, pos, newError(UNKNOWN_PROPERTY, pattern, pos, len(pattern))
+		}
+
+		end = pos + 3 + length
+		name = pattern[pos+3 : end]
+	}
+
+	if strings.HasPrefix(name, "^") {
+		class.Negated = !class.Negated
+		name = name[1:]
+	}
+
+	table := unicode.Categories[name]
+	if table == nil {
+		table = unicode.Scripts[name]
+	}
+
+	switch {
+	case name == "Any":
+		class.Ranges = []RuneRange{{Lo: 0, Hi: unicode.MaxRune}}
+	case table != nil:
+		class.Ranges = tableRanges(table)
+	default:
+		return class, pos, newError(UNKNOWN_PROPERTY, pattern, pos, end+1)
+	}
+
+	return class, end, nil
+}
+
+// tableRanges returns the normalized ranges of the runes in a unicode table.
+func tableRanges(table *unicode.RangeTable) []RuneRange {
+	var ranges []RuneRange
+
+	add := func(lo, hi, stride rune) {
+		if stride == 1 {
+			ranges = append(ranges, RuneRange{Lo: lo, Hi: hi})
+			return
+		}
+
+		for r := lo; r <= hi; r += stride {
+			ranges = append(ranges, RuneRange{Lo: r, Hi: r})
+		}
+	}
+
+	for _, r := range table.R16 {
+		add(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+
+	for _, r := range table.R32 {
+		add(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+
+	return NormalizeRanges(ranges)
+}
+
+// asciiRanges returns the ranges of the ASCII characters for which in is true.
+func asciiRanges(in func(c byte) bool) []RuneRange {
+	var ranges []RuneRange
+
+	for c := rune(0); c < utf8.RuneSelf; c++ {
+		if !in(byte(c)) {
+			continue
+		}
+
+		if n := len(ranges); n > 0 && ranges[n-1].Hi == c-1 {
+			ranges[n-1].Hi = c
+		} else {
+			ranges = append(ranges, RuneRange{Lo: c, Hi: c})
+		}
+	}
+
+	return ranges
+}
+
+// add merges every rune matched by class into the bracket, which still has
+// to be normalized afterwards. With fold set the class is case folded before
+// it is negated, so that [\W] keeps out 'k' and 's' under (?i) just like \W,
+// even though their fold orbits reach outside \w.
+func (b *BracketValue) add(class BracketValue, fold bool) {
+	ranges := class.Ranges
+	if fold {
+		ranges = FoldRanges(ranges)
+	}
+
+	if class.Negated {
+		ranges = NegateRanges(ranges)
+	}
+
+	b.Ranges = append(b.Ranges, ranges...)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isWordChar(c byte) bool {
+	return isDigit(c) || isAlpha(c) || c == '_'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
@@ -0,0 +1,181 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type ErrorKind string
+
+const (
+	UNCLOSED_GROUP       ErrorKind = "unclosed group"
+	UNMATCHED_PAREN      ErrorKind = "unmatched closing parenthesis"
+	UNCLOSED_BRACKET     ErrorKind = "unclosed bracket"
+	UNCLOSED_COMMENT     ErrorKind = "unclosed comment"
+	BAD_RANGE            ErrorKind = "invalid bracket range"
+	UNKNOWN_CLASS        ErrorKind = "unknown POSIX class"
+	UNKNOWN_PROPERTY     ErrorKind = "unknown Unicode property"
+	BAD_REPEAT           ErrorKind = "bad repeat count"
+	REPEAT_TOO_LARGE     ErrorKind = "repeat count too large"
+	DANGLING_QUANTIFIER  ErrorKind = "dangling quantifier"
+	NESTED_QUANTIFIER    ErrorKind = "nested quantifier"
+	TRAILING_BACKSLASH   ErrorKind = "trailing backslash"
+	BAD_ESCAPE           ErrorKind = "bad escape sequence"
+	UNKNOWN_ESCAPE       ErrorKind = "unknown escape sequence"
+	INVALID_UTF8         ErrorKind = "invalid UTF-8"
+	BAD_FLAGS            ErrorKind = "invalid inline flags"
+	BAD_GROUP_NAME       ErrorKind = "invalid group name"
+	DUPLICATE_GROUP_NAME ErrorKind = "duplicate group name"
+	UNKNOWN_GROUP        ErrorKind = "reference to undefined group"
+	BAD_CONDITIONAL      ErrorKind = "invalid conditional"
+)
+
+// ParseError is returned by Parse when the pattern is malformed.
+// Pos is the byte offset of the offending Fragment within the pattern.
+type ParseError struct {
+	Kind     ErrorKind
+	Pos      int
+	Fragment string
+	Hint     string
+
+	// position of the last byte the failed construct consumed; parsing
+	// resumes right after it
+	resume int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %q", e.Kind, e.Pos, e.Fragment)
+}
+
+// Diagnostic renders the error compiler-style: the pattern on one line and a
+// "^~~~" marker under the offending fragment followed by the hint.
+func (e *ParseError) Diagnostic(pattern string) string {
+	// keep the marker aligned with patterns spanning several lines
+	line := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, pattern)
+
+	// count columns in characters rather than bytes
+	marker := "^"
+	if width := utf8.RuneCountInString(e.Fragment); width > 1 {
+		marker += strings.Repeat("~", width-1)
+	}
+
+	column := utf8.RuneCountInString(pattern[:e.Pos])
+
+	return fmt.Sprintf("error: %s at offset %d\n    %s\n    %s%s %s",
+		e.Kind, e.Pos, line, strings.Repeat(" ", column), marker, e.Hint)
+}
+
+// skipTo makes parsing resume after the next closer at or past the error,
+// or at the end of the pattern if there is none.
+func (e *ParseError) skipTo(pattern string, closer byte) *ParseError {
+	idx := strings.IndexByte(pattern[e.Pos:], closer)
+	if idx == -1 {
+		e.resume = len(pattern) - 1
+	} else {
+		e.resume = e.Pos + idx
+	}
+
+	return e
+}
+
+func newError(kind ErrorKind, pattern string, start, end int) *ParseError {
+	if end > len(pattern) {
+		end = len(pattern)
+	}
+
+	fragment := pattern[start:end]
+
+	return &ParseError{
+		Kind:     kind,
+		Pos:      start,
+		Fragment: fragment,
+		Hint:     hint(kind, fragment),
+		resume:   end - 1,
+	}
+}
+
+func hint(kind ErrorKind, fragment string) string {
+	switch kind {
+	case UNCLOSED_GROUP:
+		return "missing ')' to close this group"
+	case UNMATCHED_PAREN:
+		return "')' has no matching '('"
+	case UNCLOSED_BRACKET:
+		return "missing ']' to close this bracket"
+	case UNCLOSED_COMMENT:
+		return "missing ')' to close this comment"
+	case BAD_RANGE:
+		return fmt.Sprintf("range '%s' is out of order or ends in a class", fragment)
+	case UNKNOWN_CLASS:
+		return fmt.Sprintf("'%s' is not a POSIX class such as [:alpha:] or [:^digit:]", fragment)
+	case UNKNOWN_PROPERTY:
+		return fmt.Sprintf("'%s' is not a Unicode category or script such as \\pL, \\p{Lu} or \\p{Greek}", fragment)
+	case BAD_REPEAT:
+		return fmt.Sprintf("the minimum of '%s' is above its maximum", fragment)
+	case REPEAT_TOO_LARGE:
+		return fmt.Sprintf("repeat counts must be at most %d", DEFAULT_MAX_REPEAT)
+	case DANGLING_QUANTIFIER:
+		return fmt.Sprintf("quantifier '%s' has nothing to repeat", fragment)
+	case NESTED_QUANTIFIER:
+		return fmt.Sprintf("quantifier '%s' repeats a repeat; wrap it in a group, as in (?:a*)*", fragment)
+	case TRAILING_BACKSLASH:
+		return "use '\\\\' to match a literal backslash"
+	case BAD_ESCAPE:
+		return "'\\x' must be followed by two hex digits or a code point in braces, as in \\x{20AC}"
+	case INVALID_UTF8:
+		return "patterns must be UTF-8 encoded; use \\x{...} to match other code points"
+	case UNKNOWN_ESCAPE:
+		return fmt.Sprintf("'%s' is not a known escape sequence", fragment)
+	case BAD_GROUP_NAME:
+		return "group names are letters, digits and '_' closed by '>', as in (?P<year>...)"
+	case DUPLICATE_GROUP_NAME:
+		return fmt.Sprintf("another group is already named %q", fragment)
+	case UNKNOWN_GROUP:
+		return fmt.Sprintf("'%s' refers to a group the pattern does not have", fragment)
+	case BAD_CONDITIONAL:
+		return "conditionals look like (?(1)yes|no) or (?(<name>)yes|no), with at most two branches"
+	case BAD_FLAGS:
+		return "inline flags are made of i, m, s, U and x, as in (?i), (?ms-i) or (?i:abc)"
+	default:
+		return ""
+	}
+}
+
+// ParseErrors collects every problem found in a pattern.
+type ParseErrors struct {
+	Pattern string
+	Errors  []*ParseError
+}
+
+func (e *ParseErrors) Error() string {
+	diagnostics := make([]string, 0, len(e.Errors))
+
+	for _, err := range e.Errors {
+		diagnostics = append(diagnostics, err.Diagnostic(e.Pattern))
+	}
+
+	return strings.Join(diagnostics, "\n")
+}
+
+func (e *ParseErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+func (e *ParseErrors) sort() {
+	sort.SliceStable(e.Errors, func(i, j int) bool {
+		return e.Errors[i].Pos < e.Errors[j].Pos
+	})
+}
@@ -0,0 +1,199 @@
+package parser
+
+import (
+	"regex-engine/internals/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// zero-width escapes
+var assertions = map[byte]token.TokenType{
+	'A': token.BEGIN_TEXT,
+	'z': token.END_TEXT,
+	'b': token.WORD_BOUNDARY,
+	'B': token.NOT_WORD_BOUNDARY,
+}
+
+// parseBackslash parses an escape sequence outside of brackets.
+func parseBackslash(pattern string, context *ParseContext) *ParseError {
+	if context.pos+1 < len(pattern) {
+		if next := pattern[context.pos+1]; next == 'k' || ('1' <= next && next <= '9') { // \1 \k<name>
+			return parseBackref(pattern, context)
+		}
+
+		if assert, ok := assertions[pattern[context.pos+1]]; ok {
+			context.tokens = append(context.tokens, token.Token{Type: assert})
+			context.pos++
+			return nil
+		}
+
+		if next := pattern[context.pos+1]; next == 'p' || next == 'P' { // \pL \p{Greek}
+			class, end, err := unicodeClass(pattern, context.pos)
+			if err != nil {
+				return err
+			}
+
+			context.tokens = append(context.tokens, token.Token{
+				Type:  token.BRACKET,
+				Value: class,
+				Flags: context.flags,
+			})
+			context.pos = end
+
+			return nil
+		}
+
+		if class, ok := perlClass(pattern[context.pos+1]); ok { // \d \W
+			context.tokens = append(context.tokens, token.Token{
+				Type:  token.BRACKET,
+				Value: class,
+				Flags: context.flags,
+			})
+			context.pos++
+
+			return nil
+		}
+	}
+
+	ch, end, err := parseEscape(pattern, context.pos)
+	if err != nil {
+		return err
+	}
+
+	context.tokens = append(context.tokens, token.Token{
+		Type:  token.LITERAL,
+		Value: ch,
+		Flags: context.flags,
+	})
+	context.pos = end
+
+	return nil
+}
+
+// unknownBackref reports a backreference to a group that does not exist, or
+// not yet at that point of the pattern.
+func unknownBackref(pattern string, start, end int) *ParseError {
+	err := newError(UNKNOWN_GROUP, pattern, start, end)
+	err.Hint += "; backreferences must follow their group"
+	return err
+}
+
+// parseBackref parses \1 to \9 or \k<name>, which must refer to a group
+// opened earlier in the pattern.
+func parseBackref(pattern string, context *ParseContext) *ParseError {
+	start := context.pos
+	index := int(pattern[start+1] - '0')
+	end := start + 1
+
+	if pattern[start+1] == 'k' {
+		nameStart := start + 3
+
+		if nameStart > len(pattern) || pattern[start+2] != '<' {
+			return newError(BAD_GROUP_NAME, pattern, start, start+3)
+		}
+
+		length := strings.IndexByte(pattern[nameStart:], '>')
+		if length == -1 {
+			return newError(BAD_GROUP_NAME, pattern, nameStart, len(pattern))
+		}
+
+		end = nameStart + length
+		name := pattern[nameStart:end]
+
+		if !isGroupName(name) {
+			return newError(BAD_GROUP_NAME, pattern, nameStart, end)
+		}
+
+		index = context.shared.groupIndex(name)
+		if index == -1 {
+			return unknownBackref(pattern, start, end+1)
+		}
+	} else if index >= len(context.shared.names) {
+		return unknownBackref(pattern, start, end+1)
+	}
+
+	context.tokens = append(context.tokens, token.Token{
+		Type:  token.BACKREFERENCE,
+		Value: index,
+		Flags: context.flags,
+	})
+	context.shared.backrefs = true
+	context.pos = end
+
+	return nil
+}
+
+// parseEscape decodes the escape sequence whose backslash is at pos and
+// returns the rune it stands for along with the position of its last byte.
+// Any escaped punctuation stands for itself.
+func parseEscape(pattern string, pos int) (rune, int, *ParseError) {
+	if pos+1 >= len(pattern) {
+		return 0, pos, newError(TRAILING_BACKSLASH, pattern, pos, pos+1)
+	}
+
+	ch := pattern[pos+1]
+
+	switch ch {
+	case 'n':
+		return '\n', pos + 1, nil
+	case 't':
+		return '\t', pos + 1, nil
+	case 'r':
+		return '\r', pos + 1, nil
+	case 'f':
+		return '\f', pos + 1, nil
+	case 'v':
+		return '\v', pos + 1, nil
+	case '0':
+		return 0, pos + 1, nil
+	case 'x': // \x41 \x{20AC}
+		if pos+2 < len(pattern) && pattern[pos+2] == '{' {
+			end := strings.IndexByte(pattern[pos+3:], '}')
+			if end == -1 {
+				return 0, pos, newError(BAD_ESCAPE, pattern, pos, len(pattern))
+			}
+
+			end += pos + 3
+
+			val, err := strconv.ParseUint(pattern[pos+3:end], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(val)) {
+				return 0, pos, newError(BAD_ESCAPE, pattern, pos, end+1)
+			}
+
+			return rune(val), end, nil
+		}
+
+		if pos+3 >= len(pattern) {
+			return 0, pos, newError(BAD_ESCAPE, pattern, pos, len(pattern))
+		}
+
+		val, err := strconv.ParseUint(pattern[pos+2:pos+4], 16, 8)
+		if err != nil {
+			return 0, pos, newError(BAD_ESCAPE, pattern, pos, pos+4)
+		}
+
+		return rune(val), pos + 3, nil
+	}
+
+	if isAlnum(ch) {
+		return 0, pos, newError(UNKNOWN_ESCAPE, pattern, pos, pos+2)
+	}
+
+	return decodeRune(pattern, pos+1)
+}
+
+// decodeRune decodes the UTF-8 encoded character at pos and returns it along
+// with the position of its last byte.
+func decodeRune(pattern string, pos int) (rune, int, *ParseError) {
+	r, size := utf8.DecodeRuneInString(pattern[pos:])
+	if r == utf8.RuneError && size == 1 {
+		return 0, pos, newError(INVALID_UTF8, pattern, pos, pos+1)
+	}
+
+	return r, pos + size - 1, nil
+}
+
+func isAlnum(ch byte) bool {
+	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9')
+}
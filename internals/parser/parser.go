@@ -2,8 +2,9 @@ package parser
 
 import (
 	"fmt"
-	"os"
+	"math"
 	"regex-engine/internals/token"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -12,144 +13,793 @@ type ParseContext struct {
 	tokens []token.Token
 
 	pos int
+
+	flags token.Flags
+
+	// branches closed so far by |, folded into an OR token by endBranches
+	branches []token.Token
+
+	// shared by every nested context of a single Parse call
+	shared *parseState
+}
+
+type parseState struct {
+	errors *ParseErrors
+
+	// capture group names by index, "" when unnamed; index 0 is the whole match
+	names []string
+
+	// set once a backreference or a conditional is parsed
+	backrefs bool
+
+	// set once a recursion or subroutine call is parsed
+	subroutines bool
+
+	// largest count allowed in a repeat bracket
+	maxRepeat int
+
+	// names of every group in the pattern, known on the second pass over a
+	// pattern that refers to groups opened later; nil on the first pass
+	allNames []string
+
+	// set on the first pass by a reference to a group not opened yet
+	forward bool
+}
+
+// groupIndex returns the index of the group with the given name, or -1.
+func (s *parseState) groupIndex(name string) int {
+	for i, other := range s.names {
+		if other == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// resolveGroup returns the index of the group a conditional or subroutine
+// call refers to by index, or by name if name is not "". Unlike a backreference it may refer
+// to a group opened later in the pattern; such a group resolves to 0 on the
+// first pass, which asks for a second one. It returns -1 for a group the
+// pattern does not have.
+func (s *parseState) resolveGroup(index int, name string) int {
+	names := s.names
+	if s.allNames != nil {
+		names = s.allNames
+	}
+
+	if name != "" {
+		index = slices.Index(names, name)
+	}
+
+	switch {
+	case 0 <= index && index < len(names):
+		return index
+	case s.allNames == nil:
+		s.forward = true
+		return 0
+	default:
+		return -1
+	}
 }
 
+// Options control how a pattern is parsed.
+type Options struct {
+	// flags in effect at the start of the pattern
+	Flags token.Flags
+
+	// largest count allowed in a repeat bracket such as a{2,5}, and largest
+	// product of nested counts; DEFAULT_MAX_REPEAT when zero
+	MaxRepeat int
+}
+
+// DEFAULT_MAX_REPEAT is the largest repeat count allowed unless
+// Options.MaxRepeat says otherwise; it also bounds the product of the counts
+// of nested repeats, as in (?:a{10}){20}. Every repetition is compiled into
+// its own copy of the operand, so large counts make large automata.
+const DEFAULT_MAX_REPEAT = 1000
+
 func (p *ParseContext) GetTokens() []token.Token {
 	return p.tokens
 }
 
-func Parse(pattern string) *ParseContext {
+// GetSubexpNames returns the name of every capture group by index, with ""
+// for unnamed groups and for index 0, which stands for the whole match.
+func (p *ParseContext) GetSubexpNames() []string {
+	return p.shared.names
+}
+
+// HasBackrefs reports whether the pattern refers back to what a group
+// captured, through a backreference or a conditional, which a plain
+// automaton cannot match.
+func (p *ParseContext) HasBackrefs() bool {
+	return p.shared.backrefs
+}
+
+// HasSubroutines reports whether the pattern calls itself or one of its
+// groups, as in (?R) or (?1).
+func (p *ParseContext) HasSubroutines() bool {
+	return p.shared.subroutines
+}
+
+// child returns a context for a nested construct starting at pos.
+func (p *ParseContext) child(pos int) *ParseContext {
+	return &ParseContext{
+		pos:    pos,
+		tokens: []token.Token{},
+		flags:  p.flags,
+		shared: p.shared,
+	}
+}
+
+// recover records err and moves past the construct that failed so parsing
+// can carry on and report any further problems.
+func (p *ParseContext) recover(err *ParseError) {
+	p.shared.errors.Errors = append(p.shared.errors.Errors, err)
+	p.pos = err.resume
+}
+
+// endBranches folds the alternatives split by | into a single OR token once
+// the whole context has been parsed.
+func (p *ParseContext) endBranches() {
+	if len(p.branches) == 0 {
+		return
+	}
+
+	alternatives := append(p.branches, token.Token{
+		Type:  token.UNCAPTURE_GROUP,
+		Value: p.tokens,
+		Flags: p.flags,
+	})
+
+	p.tokens = []token.Token{
+		{Type: token.OR, Value: alternatives},
+	}
+	p.branches = nil
+}
+
+// Parse tokenizes the pattern. A malformed pattern yields a *ParseErrors
+// listing every problem found; errors.As also unwraps it to the first
+// *ParseError.
+func Parse(pattern string) (*ParseContext, error) {
+	return ParseWithOptions(pattern, Options{})
+}
+
+func ParseWithOptions(pattern string, opts Options) (*ParseContext, error) {
+	if opts.MaxRepeat <= 0 {
+		opts.MaxRepeat = DEFAULT_MAX_REPEAT
+	}
+
+	context := parseAll(pattern, opts, nil)
+
+	// references to groups opened later can only be resolved once every
+	// group has been seen
+	if context.shared.forward {
+		context = parseAll(pattern, opts, context.shared.names)
+	}
+
+	if errs := context.shared.errors; len(errs.Errors) > 0 {
+		errs.sort()
+		return nil, errs
+	}
+
+	return context, nil
+}
+
+// parseAll parses the whole pattern, resolving references to groups against
+// allNames when it is not nil.
+func parseAll(pattern string, opts Options, allNames []string) *ParseContext {
 	context := &ParseContext{
 		pos:    0,
 		tokens: []token.Token{},
+		flags:  opts.Flags,
+		shared: &parseState{
+			errors:    &ParseErrors{Pattern: pattern},
+			names:     []string{""},
+			maxRepeat: opts.MaxRepeat,
+			allNames:  allNames,
+		},
 	}
 
 	for context.pos < len(pattern) {
-		parsePattern(pattern, context)
+		parseNext(pattern, context)
 		context.pos++
 	}
 
+	context.endBranches()
+
 	return context
 }
 
-func parsePattern(pattern string, context *ParseContext) {
+// parseNext parses the construct at context.pos, recovering from any error.
+func parseNext(pattern string, context *ParseContext) {
+	if err := parsePattern(pattern, context); err != nil {
+		context.recover(err)
+	}
+}
+
+func parsePattern(pattern string, context *ParseContext) *ParseError {
 	curChar := pattern[context.pos]
 
-	switch curChar {
-	case '(': // (abc)
-		groupContext := &ParseContext{
-			pos:    context.pos,
-			tokens: []token.Token{},
+	if context.flags&token.FLAG_EXTENDED != 0 {
+		if isSpace(curChar) {
+			return nil
 		}
 
-		parseGroup(pattern, groupContext)
+		if curChar == '#' { // # comment until the end of the line
+			end := strings.IndexByte(pattern[context.pos:], '\n')
+			if end == -1 {
+				context.pos = len(pattern) - 1
+			} else {
+				context.pos += end
+			}
 
-		context.tokens = append(context.tokens, token.Token{
-			Type:  token.GROUP,
-			Value: groupContext.tokens,
-		})
-		context.pos = groupContext.pos
+			return nil
+		}
+	}
 
+	switch curChar {
+	case '(': // (abc)
+		switch rest := pattern[context.pos:]; {
+		case strings.HasPrefix(rest, "(?#"): // (?#comment)
+			end := strings.IndexByte(rest, ')')
+			if end == -1 {
+				return newError(UNCLOSED_COMMENT, pattern, context.pos, len(pattern))
+			}
+
+			context.pos += end
+			return nil
+		case strings.HasPrefix(rest, "(?:"): // (?:abc)
+			return parseGroup(pattern, context, token.UNCAPTURE_GROUP, 3)
+		case strings.HasPrefix(rest, "(?>"): // (?>abc)
+			return parseGroup(pattern, context, token.ATOMIC_GROUP, 3)
+		case strings.HasPrefix(rest, "(?="): // (?=abc)
+			return parseGroup(pattern, context, token.LOOKAHEAD, 3)
+		case strings.HasPrefix(rest, "(?!"): // (?!abc)
+			return parseGroup(pattern, context, token.NEGATIVE_LOOKAHEAD, 3)
+		case strings.HasPrefix(rest, "(?<="): // (?<=abc)
+			return parseGroup(pattern, context, token.LOOKBEHIND, 4)
+		case strings.HasPrefix(rest, "(?<!"): // (?<!abc)
+			return parseGroup(pattern, context, token.NEGATIVE_LOOKBEHIND, 4)
+		case strings.HasPrefix(rest, "(?("): // (?(1)yes|no)
+			return parseConditional(pattern, context)
+		case strings.HasPrefix(rest, "(?R"), strings.HasPrefix(rest, "(?") && len(rest) > 2 && isDigit(rest[2]): // (?R) (?1)
+			return parseSubroutine(pattern, context, 2)
+		case strings.HasPrefix(rest, "(?&"): // (?&name)
+			return parseSubroutine(pattern, context, 3)
+		case strings.HasPrefix(rest, "(?P>"): // (?P>name)
+			return parseSubroutine(pattern, context, 4)
+		case strings.HasPrefix(rest, "(?P<"): // (?P<name>abc)
+			return parseNamedCapture(pattern, context, 4)
+		case strings.HasPrefix(rest, "(?<"): // (?<name>abc)
+			return parseNamedCapture(pattern, context, 3)
+		case strings.HasPrefix(rest, "(?"): // (?m) (?i-s) (?i:abc)
+			return parseFlags(pattern, context)
+		default:
+			return parseCapture(pattern, context, "", 1)
+		}
+
+	case ')':
+		return newError(UNMATCHED_PAREN, pattern, context.pos, context.pos+1)
 	case '[': // [abc]
-		parseBracket(pattern, context)
-	case '|': //[a-e]
-		parseOr(pattern, context)
+		return parseBracket(pattern, context)
+	case '|': // a|b|c
+		return parseOr(pattern, context)
 	case '{': // {3, } {3, 4} {,10}
-		parseRepeat(pattern, context)
+		return parseRepeat(pattern, context)
 	case '*', '?', '+': // a*, a?, a+
-		parseRepeat(pattern, context)
+		return parseRepeat(pattern, context)
+	case '\\': // \* \n \x41
+		return parseBackslash(pattern, context)
+	case '.':
+		context.tokens = append(context.tokens, token.Token{
+			Type:  token.ANY,
+			Flags: context.flags,
+		})
+	case '^':
+		if context.flags&token.FLAG_MULTILINE != 0 {
+			context.tokens = append(context.tokens, token.Token{Type: token.BEGIN_LINE})
+		} else {
+			context.tokens = append(context.tokens, token.Token{Type: token.BEGIN_TEXT})
+		}
+	case '$':
+		if context.flags&token.FLAG_MULTILINE != 0 {
+			context.tokens = append(context.tokens, token.Token{Type: token.END_LINE})
+		} else {
+			context.tokens = append(context.tokens, token.Token{Type: token.END_TEXT})
+		}
 	default:
 		// literal
+		r, end, err := decodeRune(pattern, context.pos)
+		if err != nil {
+			return err
+		}
+
 		context.tokens = append(context.tokens, token.Token{
 			Type:  token.LITERAL,
-			Value: curChar,
+			Value: r,
+			Flags: context.flags,
 		})
+		context.pos = end
+	}
+
+	return nil
+}
+
+type GroupValue struct {
+	Tokens []token.Token
+
+	// position among the capture groups, counting opening parentheses from 1
+	Index int
+	Name  string
+}
+
+// parseGroup parses a group whose opening takes prefixLen bytes, such as "("
+// or "(?:", and appends it as a token of the given type.
+func parseGroup(pattern string, context *ParseContext, groupType token.TokenType, prefixLen int) *ParseError {
+	tokens, err := parseGroupBody(pattern, context, prefixLen)
+	if err != nil {
+		return err
+	}
+
+	context.tokens = append(context.tokens, token.Token{
+		Type:  groupType,
+		Value: tokens,
+		Flags: context.flags,
+	})
+
+	return nil
+}
+
+// parseCapture parses a capturing group and numbers it in the order its
+// opening parenthesis appears in the pattern.
+func parseCapture(pattern string, context *ParseContext, name string, prefixLen int) *ParseError {
+	index := len(context.shared.names)
+	context.shared.names = append(context.shared.names, name)
+
+	tokens, err := parseGroupBody(pattern, context, prefixLen)
+	if err != nil {
+		return err
 	}
+
+	context.tokens = append(context.tokens, token.Token{
+		Type: token.GROUP,
+		Value: GroupValue{
+			Tokens: tokens,
+			Index:  index,
+			Name:   name,
+		},
+		Flags: context.flags,
+	})
+
+	return nil
 }
 
-func parseGroup(pattern string, groupContext *ParseContext) {
-	groupContext.pos++ // skip (
+// parseNamedCapture parses (?P<name>...) or (?<name>...), where the name
+// starts at prefixLen.
+func parseNamedCapture(pattern string, context *ParseContext, prefixLen int) *ParseError {
+	start := context.pos + prefixLen
+
+	end := strings.IndexByte(pattern[start:], '>')
+	if end == -1 {
+		return newError(BAD_GROUP_NAME, pattern, start, len(pattern))
+	}
+
+	end += start
+	name := pattern[start:end]
+
+	if !isGroupName(name) {
+		return newError(BAD_GROUP_NAME, pattern, start, end).skipTo(pattern, ')')
+	}
+
+	if context.shared.groupIndex(name) != -1 {
+		return newError(DUPLICATE_GROUP_NAME, pattern, start, end).skipTo(pattern, ')')
+	}
+
+	return parseCapture(pattern, context, name, end+1-context.pos)
+}
+
+func isGroupName(name string) bool {
+	if name == "" || isDigit(name[0]) {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if !isWordChar(name[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseGroupBody parses the tokens of a group whose opening takes prefixLen
+// bytes, leaving context.pos on the closing ')'.
+func parseGroupBody(pattern string, context *ParseContext, prefixLen int) ([]token.Token, *ParseError) {
+	start := context.pos
+	groupContext := context.child(context.pos + prefixLen)
 
 	for groupContext.pos < len(pattern) && pattern[groupContext.pos] != ')' {
-		parsePattern(pattern, groupContext)
+		parseNext(pattern, groupContext)
 		groupContext.pos++
 	}
 
 	if groupContext.pos >= len(pattern) || pattern[groupContext.pos] != ')' {
-		fmt.Fprintf(os.Stderr, "[ERROR] Unclosed group bracket: %s", pattern)
-		os.Exit(1)
+		return nil, newError(UNCLOSED_GROUP, pattern, start, len(pattern))
 	}
+
+	groupContext.endBranches()
+	context.pos = groupContext.pos
+
+	return groupContext.tokens, nil
 }
 
-func parseBracket(pattern string, context *ParseContext) {
-	context.pos++ // Skip [
+type ConditionalValue struct {
+	// capture group whose taking part in the match picks the branch
+	Index int
 
-	literals := []string{}
+	// UNCAPTURE_GROUP tokens for either outcome; No is empty without a |
+	Yes token.Token
+	No  token.Token
+}
 
-	for context.pos < len(pattern) && pattern[context.pos] != ']' {
-		if pattern[context.pos] == '-' {
-			literals = append(literals, fmt.Sprintf("%c%c", pattern[context.pos-1], pattern[context.pos+1]))
-			context.pos++
-		} else {
-			literals = append(literals, string(pattern[context.pos]))
+// parseConditional parses (?(1)yes|no) or (?(<name>)yes|no), whose group may
+// be opened before or after it. The body is parsed even when the condition
+// is malformed so that parsing resumes after the whole conditional.
+func parseConditional(pattern string, context *ParseContext) *ParseError {
+	start := context.pos
+	condStart := start + 3 // skip (?(
+
+	condEnd := strings.IndexByte(pattern[condStart:], ')')
+	if condEnd == -1 {
+		return newError(UNCLOSED_GROUP, pattern, start, len(pattern))
+	}
+
+	condEnd += condStart
+	cond := pattern[condStart:condEnd]
+
+	named := len(cond) > 2 && cond[0] == '<' && cond[len(cond)-1] == '>' && isGroupName(cond[1:len(cond)-1])
+
+	n, convErr := strconv.Atoi(cond)
+	numbered := convErr == nil && isDigit(cond[0]) && n > 0
+
+	index := -1
+
+	switch {
+	case named:
+		index = context.shared.resolveGroup(0, cond[1:len(cond)-1])
+	case numbered:
+		index = context.shared.resolveGroup(n, "")
+	}
+
+	var condErr *ParseError
+
+	switch {
+	case !named && !numbered:
+		condErr = newError(BAD_CONDITIONAL, pattern, condStart, condEnd)
+	case index == -1:
+		condErr = newError(UNKNOWN_GROUP, pattern, condStart, condEnd)
+	}
+
+	tokens, err := parseGroupBody(pattern, context, condEnd+1-start)
+	if err != nil {
+		return err
+	}
+
+	if condErr != nil {
+		condErr.resume = context.pos
+		return condErr
+	}
+
+	conditional := ConditionalValue{
+		Index: index,
+		Yes:   token.Token{Type: token.UNCAPTURE_GROUP, Value: tokens, Flags: context.flags},
+		No:    token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{}, Flags: context.flags},
+	}
+
+	// a | at the top of the body is the only way to get a lone OR token
+	if len(tokens) == 1 && tokens[0].Type == token.OR {
+		branches := tokens[0].Value.([]token.Token)
+		if len(branches) > 2 {
+			return newError(BAD_CONDITIONAL, pattern, start, context.pos+1)
 		}
 
-		context.pos++
+		conditional.Yes, conditional.No = branches[0], branches[1]
 	}
 
-	if context.pos >= len(pattern) || pattern[context.pos] != ']' {
-		fmt.Fprintf(os.Stderr, "[ERROR] Unclosed bracket: %s", pattern)
-		os.Exit(1)
+	context.tokens = append(context.tokens, token.Token{
+		Type:  token.CONDITIONAL,
+		Value: conditional,
+		Flags: context.flags,
+	})
+	context.shared.backrefs = true
+
+	return nil
+}
+
+// parseSubroutine parses (?R), (?1), (?&name) or (?P>name), whose reference
+// starts at prefixLen. The group may be opened anywhere in the pattern,
+// including around the call itself.
+func parseSubroutine(pattern string, context *ParseContext, prefixLen int) *ParseError {
+	start := context.pos
+
+	end := strings.IndexByte(pattern[start:], ')')
+	if end == -1 {
+		return newError(UNCLOSED_GROUP, pattern, start, len(pattern))
 	}
 
-	literalSet := map[byte]bool{}
+	end += start
+	ref := pattern[start+prefixLen : end]
+	index := -1
 
-	for _, literal := range literals {
-		for c := literal[0]; c <= literal[len(literal)-1]; c++ {
-			literalSet[c] = true
+	switch {
+	case prefixLen > 2: // by name
+		if !isGroupName(ref) {
+			err := newError(BAD_GROUP_NAME, pattern, start+prefixLen, end)
+			err.resume = end
+			return err
+		}
+
+		index = context.shared.resolveGroup(0, ref)
+	case ref == "R":
+		index = 0
+	default:
+		if n, err := strconv.Atoi(ref); err == nil && isDigit(ref[0]) {
+			index = context.shared.resolveGroup(n, "")
 		}
 	}
 
+	if index == -1 {
+		err := newError(UNKNOWN_GROUP, pattern, start+prefixLen, end)
+		err.resume = end
+		return err
+	}
+
 	context.tokens = append(context.tokens, token.Token{
-		Type:  token.BRACKET,
-		Value: literalSet,
+		Type:  token.SUBROUTINE,
+		Value: index,
+		Flags: context.flags,
 	})
+	context.shared.subroutines = true
+	context.pos = end
+
+	return nil
 }
 
-func parseOr(pattern string, context *ParseContext) {
-	context.pos++ // skipping |
+// inline flag letters and the flag each one stands for
+var flagLetters = map[byte]token.Flags{
+	'i': token.FLAG_CASE_INSENSITIVE,
+	'm': token.FLAG_MULTILINE,
+	's': token.FLAG_DOT_NL,
+	'U': token.FLAG_UNGREEDY,
+	'x': token.FLAG_EXTENDED,
+}
 
-	rightContext := &ParseContext{
-		pos:    context.pos,
-		tokens: []token.Token{},
+// parseFlags parses an inline flag group such as (?m), (?i-s) or (?i:abc),
+// where the letters after '-' turn flags off. The flags of (?m) stay in
+// effect until the end of the enclosing group, those of (?i:abc) only inside
+// it.
+func parseFlags(pattern string, context *ParseContext) *ParseError {
+	start := context.pos
+	pos := start + 2 // skip (?
+	flags := context.flags
+	negated := false
+	letters := 0 // since the start or the '-'
+
+	for ; pos < len(pattern) && pattern[pos] != ')' && pattern[pos] != ':'; pos++ {
+		if pattern[pos] == '-' && !negated {
+			negated = true
+			letters = 0
+			continue
+		}
+
+		flag, ok := flagLetters[pattern[pos]]
+		if !ok {
+			return newError(BAD_FLAGS, pattern, pos, pos+1).skipTo(pattern, ')')
+		}
+
+		if negated {
+			flags &^= flag
+		} else {
+			flags |= flag
+		}
+
+		letters++
 	}
 
-	for rightContext.pos < len(pattern) && pattern[rightContext.pos] != ')' {
-		parsePattern(pattern, rightContext)
-		rightContext.pos++
+	if pos >= len(pattern) {
+		return newError(UNCLOSED_GROUP, pattern, start, len(pattern))
 	}
 
-	// Decrementing pos by one since the bracket condition will be checked in outer parseGroup,
-	// otherwise it will throw error
-	if rightContext.pos < len(pattern) && pattern[rightContext.pos] == ')' {
-		rightContext.pos--
+	if letters == 0 {
+		return newError(BAD_FLAGS, pattern, start, pos+1).skipTo(pattern, ')')
 	}
 
-	left := token.Token{
-		Type:  token.UNCAPTURE_GROUP,
-		Value: context.tokens,
+	if pattern[pos] == ':' {
+		outer := context.flags
+		context.flags = flags
+
+		tokens, err := parseGroupBody(pattern, context, pos+1-start)
+		context.flags = outer
+
+		if err != nil {
+			return err
+		}
+
+		context.tokens = append(context.tokens, token.Token{
+			Type:  token.UNCAPTURE_GROUP,
+			Value: tokens,
+			Flags: flags,
+		})
+
+		return nil
 	}
 
-	right := token.Token{
-		Type:  token.UNCAPTURE_GROUP,
-		Value: rightContext.tokens,
+	context.flags = flags
+	context.pos = pos
+
+	return nil
+}
+
+type BracketValue struct {
+	// sorted ranges that neither overlap nor touch
+	Ranges []RuneRange
+
+	// match every rune not in Ranges
+	Negated bool
+}
+
+// parseBracket follows the POSIX rules: a ']' right after the opening '[' or
+// '[^' and a '-' at either end of the bracket are literals.
+func parseBracket(pattern string, context *ParseContext) *ParseError {
+	start := context.pos
+	context.pos++ // Skip [
+
+	bracket := BracketValue{}
+
+	if context.pos < len(pattern) && pattern[context.pos] == '^' {
+		bracket.Negated = true
+		context.pos++
+	}
+
+	first := context.pos
+
+	for context.pos < len(pattern) && (pattern[context.pos] != ']' || context.pos == first) {
+		itemStart := context.pos
+
+		class, ok, err := parseBracketClass(pattern, context)
+		if err != nil {
+			return err.skipTo(pattern, ']')
+		}
+
+		if ok {
+			bracket.add(class, context.flags&token.FLAG_CASE_INSENSITIVE != 0)
+			context.pos++
+			continue
+		}
+
+		from, err := parseBracketChar(pattern, context)
+		if err != nil {
+			return err.skipTo(pattern, ']')
+		}
+
+		to := from
+
+		if context.pos+2 < len(pattern) && pattern[context.pos+1] == '-' && pattern[context.pos+2] != ']' {
+			context.pos += 2 // skip -
+
+			if _, ok, _ := parseBracketClass(pattern, context); ok {
+				return newError(BAD_RANGE, pattern, itemStart, context.pos+1).skipTo(pattern, ']')
+			}
+
+			to, err = parseBracketChar(pattern, context)
+			if err != nil {
+				return err.skipTo(pattern, ']')
+			}
+
+			if to < from {
+				return newError(BAD_RANGE, pattern, itemStart, context.pos+1).skipTo(pattern, ']')
+			}
+		}
+
+		bracket.Ranges = append(bracket.Ranges, RuneRange{Lo: from, Hi: to})
+
+		context.pos++
+	}
+
+	if context.pos >= len(pattern) || pattern[context.pos] != ']' {
+		return newError(UNCLOSED_BRACKET, pattern, start, len(pattern))
+	}
+
+	bracket.Ranges = NormalizeRanges(bracket.Ranges)
+
+	context.tokens = append(context.tokens, token.Token{
+		Type:  token.BRACKET,
+		Value: bracket,
+		Flags: context.flags,
+	})
+
+	return nil
+}
+
+// parseBracketClass reads a class such as \d, \p{Greek} or [:alpha:] inside a
+// bracket, leaving context.pos on its last byte.
+func parseBracketClass(pattern string, context *ParseContext) (BracketValue, bool, *ParseError) {
+	pos := context.pos
+
+	if pos+1 >= len(pattern) {
+		return BracketValue{}, false, nil
+	}
+
+	switch {
+	case pattern[pos] == '\\' && (pattern[pos+1] == 'p' || pattern[pos+1] == 'P'):
+		class, end, err := unicodeClass(pattern, pos)
+		if err != nil {
+			return BracketValue{}, false, err
+		}
+
+		context.pos = end
+
+		return class, true, nil
+
+	case pattern[pos] == '\\':
+		class, ok := perlClass(pattern[pos+1])
+		if ok {
+			context.pos++
+		}
+
+		return class, ok, nil
+
+	case pattern[pos] == '[' && pattern[pos+1] == ':':
+		end := strings.Index(pattern[pos+2:], ":]")
+		if end == -1 { // a lone [ is a literal
+			return BracketValue{}, false, nil
+		}
+
+		end += pos + 2
+
+		class, ok := posixClass(pattern[pos+2 : end])
+		if !ok {
+			return BracketValue{}, false, newError(UNKNOWN_CLASS, pattern, pos, end+2)
+		}
+
+		context.pos = end + 1
+
+		return class, true, nil
 	}
 
-	context.pos = rightContext.pos
+	return BracketValue{}, false, nil
+}
 
-	context.tokens = []token.Token{
-		{Type: token.OR, Value: []token.Token{left, right}},
+// parseBracketChar reads a single, possibly escaped, character of a bracket
+// and leaves context.pos on its last byte.
+func parseBracketChar(pattern string, context *ParseContext) (rune, *ParseError) {
+	decode := parseEscape
+	if pattern[context.pos] != '\\' {
+		decode = decodeRune
 	}
+
+	ch, end, err := decode(pattern, context.pos)
+	if err != nil {
+		return 0, err
+	}
+
+	context.pos = end
+
+	return ch, nil
+}
+
+// parseOr closes the current branch; | binds looser than anything else so
+// the branch is everything since the start of the group or the previous |.
+func parseOr(pattern string, context *ParseContext) *ParseError {
+	context.branches = append(context.branches, token.Token{
+		Type:  token.UNCAPTURE_GROUP,
+		Value: context.tokens,
+		Flags: context.flags,
+	})
+	context.tokens = []token.Token{}
+
+	return nil
 }
 
 type RepeatValue struct {
@@ -157,86 +807,195 @@ type RepeatValue struct {
 
 	Min int
 	Max int
+
+	// prefer as few repetitions as possible, as in a*? or a{2,5}?
+	Lazy bool
 }
 
 const INFINITY = -1
 
-func parseRepeat(pattern string, context *ParseContext) {
+func parseRepeat(pattern string, context *ParseContext) *ParseError {
 	switch pattern[context.pos] {
 	case '{':
-		parseRepeatBracket(pattern, context)
+		return parseRepeatBracket(pattern, context)
 	case '*':
-		makeRepeat(0, INFINITY, context)
+		return makeRepeat(0, INFINITY, pattern, context, context.pos)
 
 	case '+':
-		makeRepeat(1, INFINITY, context)
+		return makeRepeat(1, INFINITY, pattern, context, context.pos)
 
 	case '?':
-		makeRepeat(0, 1, context)
+		return makeRepeat(0, 1, pattern, context, context.pos)
 
 	default:
-		fmt.Fprintf(os.Stderr, "Unreachable repeat character: %c", pattern[context.pos])
-		os.Exit(1)
+		return newError(DANGLING_QUANTIFIER, pattern, context.pos, context.pos+1)
 	}
 }
 
-func parseRepeatBracket(pattern string, context *ParseContext) {
-	context.pos++ // skip {
-	pos := context.pos
+// parseRepeatBracket parses {n}, {n,}, {,m} or {n,m}. Any other '{' stands
+// for itself, as in a{,} or {abc}.
+func parseRepeatBracket(pattern string, context *ParseContext) *ParseError {
+	start := context.pos
 
-	for context.pos < len(pattern) && pattern[context.pos] != '}' {
-		context.pos++
+	min, max, end, ok := repeatBounds(pattern, start)
+	if !ok {
+		context.tokens = append(context.tokens, token.Token{
+			Type:  token.LITERAL,
+			Value: '{',
+			Flags: context.flags,
+		})
+
+		return nil
 	}
 
-	expr := pattern[pos:context.pos]
+	context.pos = end
 
-	split := strings.Split(expr, ",")
+	if max != INFINITY && min > max {
+		return newError(BAD_REPEAT, pattern, start, end+1)
+	}
 
-	rep := RepeatValue{}
+	if limit := context.shared.maxRepeat; min > limit || max > limit {
+		err := newError(REPEAT_TOO_LARGE, pattern, start, end+1)
+		err.Hint = fmt.Sprintf("repeat counts must be at most %d", limit)
+		return err
+	}
 
-	// TODO: What to do if both are empty? {,}
+	return makeRepeat(min, max, pattern, context, start)
+}
 
-	if split[0] == "" {
-		rep.Min = 0
-	} else {
-		val, err := strconv.Atoi(split[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not convert %s to int", split[0])
-			os.Exit(1)
+// repeatBounds reads the bounds of the repeat bracket opened at pos and
+// returns the position of its closing '}'. It reports false if the text is
+// not a repeat bracket. Counts too big for an int come back as math.MaxInt.
+func repeatBounds(pattern string, pos int) (min, max, end int, ok bool) {
+	end = pos + 1
+
+	count := func() (int, bool) {
+		digits := end
+		for end < len(pattern) && isDigit(pattern[end]) {
+			end++
 		}
 
-		rep.Min = val
-	}
+		if end == digits {
+			return 0, false
+		}
 
-	if split[len(split)-1] == "" {
-		rep.Max = INFINITY
-	} else {
-		val, err := strconv.Atoi(split[len(split)-1])
+		n, err := strconv.Atoi(pattern[digits:end])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not convert %s to int", split[len(split)-1])
-			os.Exit(1)
+			n = math.MaxInt
 		}
 
-		rep.Max = val
+		return n, true
 	}
 
-	rep.RepeatToken = context.tokens[len(context.tokens)-1]
+	min, hasMin := count()
+	max, hasMax := min, hasMin
 
-	context.tokens[len(context.tokens)-1] = token.Token{
-		Type:  token.REPEAT,
-		Value: rep,
+	if end < len(pattern) && pattern[end] == ',' {
+		end++
+
+		max, hasMax = count()
+		if !hasMax {
+			max = INFINITY
+		}
+	}
+
+	if end >= len(pattern) || pattern[end] != '}' || (!hasMin && !hasMax) {
+		return 0, 0, 0, false
 	}
+
+	return min, max, end, true
 }
 
-func makeRepeat(min, max int, context *ParseContext) {
+// makeRepeat repeats the last token, reporting the quantifier spanning start
+// to context.pos if there is nothing to repeat or if the last token is
+// itself a repeat, as in a** or a{2}{3}.
+func makeRepeat(min, max int, pattern string, context *ParseContext, start int) *ParseError {
+	if len(context.tokens) == 0 {
+		return newError(DANGLING_QUANTIFIER, pattern, start, context.pos+1)
+	}
+
+	operand := context.tokens[len(context.tokens)-1]
+
+	switch operand.Type {
+	case token.REPEAT, token.POSSESSIVE_REPEAT:
+		return newError(NESTED_QUANTIFIER, pattern, start, context.pos+1)
+	}
+
+	// every repetition is a copy of the operand, repeats nested inside it
+	// included, so the counts multiply
+	if limit := context.shared.maxRepeat; repeatCount(min, max) > limit/nestedCount(operand) {
+		err := newError(REPEAT_TOO_LARGE, pattern, start, context.pos+1)
+		err.Hint = fmt.Sprintf("nested repeat counts multiply to more than %d", limit)
+		return err
+	}
+
 	rep := RepeatValue{}
 	rep.Min = min
 	rep.Max = max
 
+	applyRepeat(rep, pattern, context)
+
+	return nil
+}
+
+// repeatCount returns how many copies of its operand a repeat from min to
+// max compiles to, counting an unbounded repeat by its minimum.
+func repeatCount(min, max int) int {
+	if max == INFINITY {
+		max = min
+	}
+
+	if max < 1 {
+		return 1
+	}
+
+	return max
+}
+
+// nestedCount returns the largest product of the counts of the repeats
+// nested in tok.
+func nestedCount(tok token.Token) int {
+	count := 1
+
+	switch value := tok.Value.(type) {
+	case RepeatValue:
+		return repeatCount(value.Min, value.Max) * nestedCount(value.RepeatToken)
+	case GroupValue:
+		for _, t := range value.Tokens {
+			count = max(count, nestedCount(t))
+		}
+	case []token.Token:
+		for _, t := range value {
+			count = max(count, nestedCount(t))
+		}
+	case ConditionalValue:
+		count = max(nestedCount(value.Yes), nestedCount(value.No))
+	}
+
+	return count
+}
+
+// applyRepeat wraps the last token in the repeat, reading the '?' suffix that
+// makes it lazy or the '+' suffix that makes it possessive.
+func applyRepeat(rep RepeatValue, pattern string, context *ParseContext) {
+	repeatType := token.TokenType(token.REPEAT)
+
+	if context.pos+1 < len(pattern) {
+		switch pattern[context.pos+1] {
+		case '?':
+			rep.Lazy = true
+			context.pos++
+		case '+':
+			repeatType = token.POSSESSIVE_REPEAT
+			context.pos++
+		}
+	}
+
 	rep.RepeatToken = context.tokens[len(context.tokens)-1]
 
 	context.tokens[len(context.tokens)-1] = token.Token{
-		Type:  token.REPEAT,
+		Type:  repeatType,
 		Value: rep,
+		Flags: context.flags,
 	}
 }
@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"sort"
+	"unicode"
+)
+
+// RuneRange stands for the runes from Lo to Hi, both included.
+type RuneRange struct {
+	Lo rune
+	Hi rune
+}
+
+// NormalizeRanges sorts the ranges and merges those that overlap or touch.
+func NormalizeRanges(ranges []RuneRange) []RuneRange {
+	sorted := append([]RuneRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Lo < sorted[j].Lo
+	})
+
+	var merged []RuneRange
+
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.Lo <= merged[n-1].Hi+1 {
+			merged[n-1].Hi = max(merged[n-1].Hi, r.Hi)
+		} else {
+			merged = append(merged, r)
+		}
+	}
+
+	return merged
+}
+
+// NegateRanges returns the runes up to unicode.MaxRune that are missing from
+// the normalized ranges.
+func NegateRanges(ranges []RuneRange) []RuneRange {
+	var negated []RuneRange
+
+	next := rune(0)
+
+	for _, r := range ranges {
+		if r.Lo > next {
+			negated = append(negated, RuneRange{Lo: next, Hi: r.Lo - 1})
+		}
+
+		next = r.Hi + 1
+	}
+
+	if next <= unicode.MaxRune {
+		negated = append(negated, RuneRange{Lo: next, Hi: unicode.MaxRune})
+	}
+
+	return negated
+}
+
+// Lowest and highest runes with other case forms under simple folding.
+const (
+	MIN_FOLD = 0x0041
+	MAX_FOLD = 0x1e943
+)
+
+// FoldRanges adds every rune that folds to one in ranges, following the
+// unicode.SimpleFold orbits so that 'k' also brings in 'K' and the Kelvin sign.
+func FoldRanges(ranges []RuneRange) []RuneRange {
+	folded := append([]RuneRange(nil), ranges...)
+
+	for _, r := range ranges {
+		for c := max(r.Lo, MIN_FOLD); c <= min(r.Hi, MAX_FOLD); c++ {
+			for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+				folded = append(folded, RuneRange{Lo: f, Hi: f})
+			}
+		}
+	}
+
+	return NormalizeRanges(folded)
+}
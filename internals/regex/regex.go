@@ -3,12 +3,181 @@ package regex
 import (
 	"regex-engine/internals/fsm"
 	"regex-engine/internals/parser"
+	"regex-engine/internals/token"
 )
 
-// first parses then returns the nfa
-func Match(input, pattern string) bool {
-	ctx := parser.Parse(pattern)
-	state, _ := fsm.ToNfa(ctx)
+// Options tune how a pattern is compiled.
+type Options struct {
+	// let . match '\n' as well
+	DotMatchesNewline bool
 
-	return state.Check(input, 0)
+	// let ^ and $ match at the start and end of every line
+	Multiline bool
+
+	// let letters match in any case, as with (?i)
+	CaseInsensitive bool
+
+	// ignore unescaped whitespace outside brackets and treat # as the start
+	// of a comment running to the end of the line
+	Extended bool
+
+	// keep the old group semantics where "(abc)" matches any one of a, b
+	// or c instead of "abc"
+	LegacyGroups bool
+
+	// largest count allowed in a repeat bracket such as a{2,5}, and largest
+	// product of nested counts, or parser.DEFAULT_MAX_REPEAT when zero
+	MaxRepeat int
+}
+
+// Regex is a compiled pattern that can be matched many times.
+type Regex struct {
+	pattern string
+	nfa     *fsm.Nfa
+	names   []string
+}
+
+func Compile(pattern string) (*Regex, error) {
+	return CompileWithOptions(pattern, Options{})
+}
+
+func CompileWithOptions(pattern string, opts Options) (*Regex, error) {
+	ctx, err := parser.ParseWithOptions(pattern, parser.Options{
+		Flags:     opts.flags(),
+		MaxRepeat: opts.MaxRepeat,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nfa, err := fsm.ToNfa(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Regex{pattern: pattern, nfa: nfa, names: ctx.GetSubexpNames()}, nil
+}
+
+func (r *Regex) String() string {
+	return r.pattern
+}
+
+// Match reports whether the whole input matches the pattern.
+func (r *Regex) Match(input string) bool {
+	return r.nfa.Check(input)
+}
+
+// Search reports whether the pattern matches anywhere in the input.
+// Use ^ and $ to anchor it.
+func (r *Regex) Search(input string) bool {
+	return r.nfa.Find(input) != nil
+}
+
+// FindIndex returns the start and end of the leftmost match in the input,
+// or nil if there is none.
+func (r *Regex) FindIndex(input string) []int {
+	caps := r.nfa.Find(input)
+	if caps == nil {
+		return nil
+	}
+
+	return caps[:2]
+}
+
+// FindSubmatchIndex returns the bounds of the leftmost match and of every
+// capture group in it: group i spans [2*i, 2*i+1], which are -1 when the group
+// did not take part in the match. It returns nil if there is no match.
+func (r *Regex) FindSubmatchIndex(input string) []int {
+	return r.nfa.Find(input)
+}
+
+// FindStringSubmatch returns the text of the leftmost match followed by the
+// text of every capture group, "" for groups that did not take part.
+func (r *Regex) FindStringSubmatch(input string) []string {
+	caps := r.nfa.Find(input)
+	if caps == nil {
+		return nil
+	}
+
+	submatches := make([]string, len(caps)/2)
+	for i := range submatches {
+		if caps[2*i] >= 0 {
+			submatches[i] = input[caps[2*i]:caps[2*i+1]]
+		}
+	}
+
+	return submatches
+}
+
+// NumSubexp returns the number of capture groups, not counting the whole match.
+func (r *Regex) NumSubexp() int {
+	return len(r.names) - 1
+}
+
+// SubexpNames returns the name of every capture group by index; unnamed
+// groups and index 0, the whole match, have the name "".
+func (r *Regex) SubexpNames() []string {
+	return r.names
+}
+
+// SubexpIndex returns the index of the group with the given name, or -1.
+func (r *Regex) SubexpIndex(name string) int {
+	if name == "" {
+		return -1
+	}
+
+	for i, other := range r.names {
+		if other == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Match compiles the pattern and reports whether the whole input matches it.
+// It returns the compile error if the pattern is invalid.
+func Match(input, pattern string) (bool, error) {
+	r, err := Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	return r.Match(input), nil
+}
+
+// Search compiles the pattern and looks for it anywhere in the input.
+func Search(input, pattern string) (bool, error) {
+	r, err := Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	return r.Search(input), nil
+}
+
+func (o Options) flags() token.Flags {
+	var flags token.Flags
+
+	if o.DotMatchesNewline {
+		flags |= token.FLAG_DOT_NL
+	}
+
+	if o.Multiline {
+		flags |= token.FLAG_MULTILINE
+	}
+
+	if o.CaseInsensitive {
+		flags |= token.FLAG_CASE_INSENSITIVE
+	}
+
+	if o.Extended {
+		flags |= token.FLAG_EXTENDED
+	}
+
+	if o.LegacyGroups {
+		flags |= token.FLAG_LEGACY_GROUPS
+	}
+
+	return flags
 }
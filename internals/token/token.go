@@ -7,11 +7,53 @@ const (
 	REPEAT          = "Repeat"
 	OR              = "Or"
 	BRACKET         = "Bracket"
+	ANY             = "Any"
+
+	// never give back what they matched
+	POSSESSIVE_REPEAT = "Possessive_repeat"
+	ATOMIC_GROUP      = "Atomic_group"
+
+	// zero-width assertions
+	BEGIN_TEXT        = "Begin_text"
+	END_TEXT          = "End_text"
+	BEGIN_LINE        = "Begin_line"
+	END_LINE          = "End_line"
+	WORD_BOUNDARY     = "Word_boundary"
+	NOT_WORD_BOUNDARY = "Not_word_boundary"
+
+	// matches the text last captured by the group whose index is its value
+	BACKREFERENCE = "Backreference"
+
+	// matches one of two branches depending on whether a group has captured
+	CONDITIONAL = "Conditional"
+
+	// matches the group whose index is its value again, or the whole pattern
+	// for index 0
+	SUBROUTINE = "Subroutine"
+
+	// zero-width, match their tokens ahead of or behind the current position
+	LOOKAHEAD           = "Lookahead"
+	NEGATIVE_LOOKAHEAD  = "Negative_lookahead"
+	LOOKBEHIND          = "Lookbehind"
+	NEGATIVE_LOOKBEHIND = "Negative_lookbehind"
 )
 
 type TokenType string
 
+// Flags are the matching options in effect where a token was parsed.
+type Flags uint8
+
+const (
+	FLAG_DOT_NL           Flags = 1 << iota // . also matches '\n'
+	FLAG_MULTILINE                          // ^ and $ also match around '\n'
+	FLAG_LEGACY_GROUPS                      // groups match any one of their tokens
+	FLAG_CASE_INSENSITIVE                   // letters match all of their case forms
+	FLAG_UNGREEDY                           // repeats are lazy unless followed by '?'
+	FLAG_EXTENDED                           // whitespace and # comments outside brackets are ignored
+)
+
 type Token struct {
 	Value interface{}
 	Type  TokenType
+	Flags Flags
 }
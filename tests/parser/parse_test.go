@@ -1,11 +1,13 @@
 package parser_test
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"regex-engine/internals/parser"
 	"regex-engine/internals/token"
 	"testing"
+	"unicode"
 )
 
 func TestParser(t *testing.T) {
@@ -17,7 +19,124 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "a",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('a')},
+				{Type: token.LITERAL, Value: 'a'},
+			},
+		},
+
+		// escapes
+		{
+			pattern: `\*\(\\`,
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: '*'},
+				{Type: token.LITERAL, Value: '('},
+				{Type: token.LITERAL, Value: '\\'},
+			},
+		},
+		{
+			pattern: `\n\t\r\f\v\0\x41`,
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: '\n'},
+				{Type: token.LITERAL, Value: '\t'},
+				{Type: token.LITERAL, Value: '\r'},
+				{Type: token.LITERAL, Value: '\f'},
+				{Type: token.LITERAL, Value: '\v'},
+				{Type: token.LITERAL, Value: rune(0)},
+				{Type: token.LITERAL, Value: 'A'},
+			},
+		},
+		{
+			pattern: `a\+`,
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.LITERAL, Value: '+'},
+			},
+		},
+		{
+			pattern: `[\]\-\x30-\x32]`,
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: '-', Hi: '-'}, {Lo: '0', Hi: '2'}, {Lo: ']', Hi: ']'}}}},
+			},
+		},
+		{
+			pattern: `é[à-ç\x{20AC}]`,
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: 'é'},
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: 'à', Hi: 'ç'}, {Lo: '€', Hi: '€'}}}},
+			},
+		},
+		{
+			pattern: `\p{Greek}\PN`,
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: parser.NormalizeRanges(tableRanges(unicode.Greek))}},
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: parser.NormalizeRanges(tableRanges(unicode.N)), Negated: true}},
+			},
+		},
+		{
+			pattern: `[\p{^Lu}x]`,
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: parser.NormalizeRanges(
+					append(parser.NegateRanges(tableRanges(unicode.Lu)), parser.RuneRange{Lo: 'x', Hi: 'x'}),
+				)}},
+			},
+		},
+
+		// dot
+		{
+			pattern: "a.",
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.ANY},
+			},
+		},
+		{
+			pattern: `\.`,
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: '.'},
+			},
+		},
+
+		// anchors
+		{
+			pattern: `^a$`,
+			tokens: []token.Token{
+				{Type: token.BEGIN_TEXT},
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.END_TEXT},
+			},
+		},
+		{
+			pattern: `\Aa\z`,
+			tokens: []token.Token{
+				{Type: token.BEGIN_TEXT},
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.END_TEXT},
+			},
+		},
+
+		{
+			pattern: `\ba\B`,
+			tokens: []token.Token{
+				{Type: token.WORD_BOUNDARY},
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.NOT_WORD_BOUNDARY},
+			},
+		},
+
+		{
+			pattern: `^(?m)^$`,
+			tokens: []token.Token{
+				{Type: token.BEGIN_TEXT},
+				{Type: token.BEGIN_LINE},
+				{Type: token.END_LINE},
+			},
+		},
+		{
+			pattern: `((?m)^)^`,
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Tokens: []token.Token{
+					{Type: token.BEGIN_LINE},
+				}}},
+				{Type: token.BEGIN_TEXT},
 			},
 		},
 
@@ -27,10 +146,13 @@ func TestParser(t *testing.T) {
 			tokens: []token.Token{
 				{
 					Type: token.GROUP,
-					Value: []token.Token{
-						{Type: token.LITERAL, Value: byte('a')},
-						{Type: token.LITERAL, Value: byte('b')},
-						{Type: token.LITERAL, Value: byte('c')},
+					Value: parser.GroupValue{
+						Index: 1,
+						Tokens: []token.Token{
+							{Type: token.LITERAL, Value: 'a'},
+							{Type: token.LITERAL, Value: 'b'},
+							{Type: token.LITERAL, Value: 'c'},
+						},
 					},
 				},
 			},
@@ -39,10 +161,10 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "a()",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('a')},
+				{Type: token.LITERAL, Value: 'a'},
 				{
 					Type:  token.GROUP,
-					Value: []token.Token{},
+					Value: parser.GroupValue{Index: 1, Tokens: []token.Token{}},
 				},
 			},
 		},
@@ -50,44 +172,140 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "a(bc)",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('a')},
+				{Type: token.LITERAL, Value: 'a'},
 				{
 					Type: token.GROUP,
+					Value: parser.GroupValue{
+						Index: 1,
+						Tokens: []token.Token{
+							{Type: token.LITERAL, Value: 'b'},
+							{Type: token.LITERAL, Value: 'c'},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			pattern: "(?:ab)c",
+			tokens: []token.Token{
+				{
+					Type: token.UNCAPTURE_GROUP,
 					Value: []token.Token{
-						{Type: token.LITERAL, Value: byte('b')},
-						{Type: token.LITERAL, Value: byte('c')},
+						{Type: token.LITERAL, Value: 'a'},
+						{Type: token.LITERAL, Value: 'b'},
 					},
 				},
+				{Type: token.LITERAL, Value: 'c'},
 			},
 		},
 
 		{
-			pattern: "[abc]",
+			pattern: "(?P<year>a)((?<b>b))",
 			tokens: []token.Token{
-				{Type: token.BRACKET, Value: map[byte]bool{
-					byte('a'): true,
-					byte('b'): true,
-					byte('c'): true,
+				{Type: token.GROUP, Value: parser.GroupValue{
+					Index:  1,
+					Name:   "year",
+					Tokens: []token.Token{{Type: token.LITERAL, Value: 'a'}},
+				}},
+				{Type: token.GROUP, Value: parser.GroupValue{
+					Index: 2,
+					Tokens: []token.Token{
+						{Type: token.GROUP, Value: parser.GroupValue{
+							Index:  3,
+							Name:   "b",
+							Tokens: []token.Token{{Type: token.LITERAL, Value: 'b'}},
+						}},
+					},
 				}},
 			},
 		},
+
+		{
+			pattern: "[abc]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: 'a', Hi: 'c'}}}},
+			},
+		},
 		{
 			pattern: "[a-c]",
 			tokens: []token.Token{
-				{Type: token.BRACKET, Value: map[byte]bool{
-					byte('a'): true,
-					byte('b'): true,
-					byte('c'): true,
-				}},
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: 'a', Hi: 'c'}}}},
 			},
 		},
 		{
 			pattern: "[ab-c]",
 			tokens: []token.Token{
-				{Type: token.BRACKET, Value: map[byte]bool{
-					byte('a'): true,
-					byte('b'): true,
-					byte('c'): true,
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: 'a', Hi: 'c'}}}},
+			},
+		},
+
+		{
+			pattern: "[^a-c]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{
+					Ranges:  []parser.RuneRange{{Lo: 'a', Hi: 'c'}},
+					Negated: true,
+				}},
+			},
+		},
+		{
+			pattern: "[]a]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: ']', Hi: ']'}, {Lo: 'a', Hi: 'a'}}}},
+			},
+		},
+		{
+			pattern: "[^]-]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{
+					Ranges:  []parser.RuneRange{{Lo: '-', Hi: '-'}, {Lo: ']', Hi: ']'}},
+					Negated: true,
+				}},
+			},
+		},
+		{
+			pattern: "[-a]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: '-', Hi: '-'}, {Lo: 'a', Hi: 'a'}}}},
+			},
+		},
+		{
+			pattern: "[a-]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: '-', Hi: '-'}, {Lo: 'a', Hi: 'a'}}}},
+			},
+		},
+
+		{
+			pattern: `\d\S`,
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: '0', Hi: '9'}}}},
+				{Type: token.BRACKET, Value: parser.BracketValue{
+					Ranges:  []parser.RuneRange{{Lo: '\t', Hi: '\r'}, {Lo: ' ', Hi: ' '}},
+					Negated: true,
+				}},
+			},
+		},
+		{
+			pattern: `[\d_-]`,
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: '-', Hi: '-'}, {Lo: '0', Hi: '9'}, {Lo: '_', Hi: '_'}}}},
+			},
+		},
+
+		{
+			pattern: "[[:digit:]x]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: '0', Hi: '9'}, {Lo: 'x', Hi: 'x'}}}},
+			},
+		},
+		{
+			pattern: "[^[:blank:][]",
+			tokens: []token.Token{
+				{Type: token.BRACKET, Value: parser.BracketValue{
+					Ranges:  []parser.RuneRange{{Lo: '\t', Hi: '\t'}, {Lo: ' ', Hi: ' '}, {Lo: '[', Hi: '['}},
+					Negated: true,
 				}},
 			},
 		},
@@ -100,10 +318,10 @@ func TestParser(t *testing.T) {
 					Type: token.OR,
 					Value: []token.Token{
 						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-							{Type: token.LITERAL, Value: byte('a')},
+							{Type: token.LITERAL, Value: 'a'},
 						}},
 						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-							{Type: token.LITERAL, Value: byte('b')},
+							{Type: token.LITERAL, Value: 'b'},
 						}},
 					},
 				},
@@ -114,16 +332,19 @@ func TestParser(t *testing.T) {
 			tokens: []token.Token{
 				{
 					Type: token.GROUP,
-					Value: []token.Token{
-						{
-							Type: token.OR,
-							Value: []token.Token{
-								{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-									{Type: token.LITERAL, Value: byte('a')},
-								}},
-								{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-									{Type: token.LITERAL, Value: byte('b')},
-								}},
+					Value: parser.GroupValue{
+						Index: 1,
+						Tokens: []token.Token{
+							{
+								Type: token.OR,
+								Value: []token.Token{
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'a'},
+									}},
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'b'},
+									}},
+								},
 							},
 						},
 					},
@@ -133,19 +354,22 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "c(a|b)",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('c')},
+				{Type: token.LITERAL, Value: 'c'},
 				{
 					Type: token.GROUP,
-					Value: []token.Token{
-						{
-							Type: token.OR,
-							Value: []token.Token{
-								{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-									{Type: token.LITERAL, Value: byte('a')},
-								}},
-								{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-									{Type: token.LITERAL, Value: byte('b')},
-								}},
+					Value: parser.GroupValue{
+						Index: 1,
+						Tokens: []token.Token{
+							{
+								Type: token.OR,
+								Value: []token.Token{
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'a'},
+									}},
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'b'},
+									}},
+								},
 							},
 						},
 					},
@@ -157,21 +381,24 @@ func TestParser(t *testing.T) {
 			tokens: []token.Token{
 				{
 					Type: token.GROUP,
-					Value: []token.Token{
-						{
-							Type: token.OR,
-							Value: []token.Token{
-								{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-									{Type: token.LITERAL, Value: byte('a')},
-								}},
-								{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-									{Type: token.LITERAL, Value: byte('b')},
-								}},
+					Value: parser.GroupValue{
+						Index: 1,
+						Tokens: []token.Token{
+							{
+								Type: token.OR,
+								Value: []token.Token{
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'a'},
+									}},
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'b'},
+									}},
+								},
 							},
 						},
 					},
 				},
-				{Type: token.LITERAL, Value: byte('c')},
+				{Type: token.LITERAL, Value: 'c'},
 			},
 		},
 		{
@@ -181,14 +408,86 @@ func TestParser(t *testing.T) {
 					Type: token.OR,
 					Value: []token.Token{
 						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-							{Type: token.BRACKET, Value: map[byte]bool{
-								byte('a'): true,
-								byte('b'): true,
-								byte('c'): true,
-							}},
+							{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: 'a', Hi: 'c'}}}},
+						}},
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+							{Type: token.LITERAL, Value: 'z'},
+						}},
+					},
+				},
+			},
+		},
+
+		{
+			pattern: "a|b|c",
+			tokens: []token.Token{
+				{
+					Type: token.OR,
+					Value: []token.Token{
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+							{Type: token.LITERAL, Value: 'a'},
+						}},
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+							{Type: token.LITERAL, Value: 'b'},
 						}},
 						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-							{Type: token.LITERAL, Value: byte('z')},
+							{Type: token.LITERAL, Value: 'c'},
+						}},
+					},
+				},
+			},
+		},
+		{
+			pattern: "(xab|cd)e",
+			tokens: []token.Token{
+				{
+					Type: token.GROUP,
+					Value: parser.GroupValue{
+						Index: 1,
+						Tokens: []token.Token{
+							{
+								Type: token.OR,
+								Value: []token.Token{
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'x'},
+										{Type: token.LITERAL, Value: 'a'},
+										{Type: token.LITERAL, Value: 'b'},
+									}},
+									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+										{Type: token.LITERAL, Value: 'c'},
+										{Type: token.LITERAL, Value: 'd'},
+									}},
+								},
+							},
+						},
+					},
+				},
+				{Type: token.LITERAL, Value: 'e'},
+			},
+		},
+		{
+			pattern: "a|",
+			tokens: []token.Token{
+				{
+					Type: token.OR,
+					Value: []token.Token{
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+							{Type: token.LITERAL, Value: 'a'},
+						}},
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{}},
+					},
+				},
+			},
+		},
+		{
+			pattern: "|a",
+			tokens: []token.Token{
+				{
+					Type: token.OR,
+					Value: []token.Token{
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{}},
+						{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+							{Type: token.LITERAL, Value: 'a'},
 						}},
 					},
 				},
@@ -200,7 +499,7 @@ func TestParser(t *testing.T) {
 			pattern: "a{1,3}",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 1,
 					Max: 3,
@@ -211,20 +510,20 @@ func TestParser(t *testing.T) {
 			pattern: "a{,3}c",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 0,
 					Max: 3,
 				}},
-				{Type: token.LITERAL, Value: byte('c')},
+				{Type: token.LITERAL, Value: 'c'},
 			},
 		},
 		{
 			pattern: "ba{1,}",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('b')},
+				{Type: token.LITERAL, Value: 'b'},
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 1,
 					Max: parser.INFINITY,
@@ -232,12 +531,44 @@ func TestParser(t *testing.T) {
 			},
 		},
 
+		{
+			pattern: "a{2,3}?",
+			tokens: []token.Token{
+				{Type: token.REPEAT, Value: parser.RepeatValue{
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
+
+					Min:  2,
+					Max:  3,
+					Lazy: true,
+				}},
+			},
+		},
+
+		// braces that are not a repeat are literals
+		{
+			pattern: "a{,}",
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.LITERAL, Value: '{'},
+				{Type: token.LITERAL, Value: ','},
+				{Type: token.LITERAL, Value: '}'},
+			},
+		},
+		{
+			pattern: "{a2",
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: '{'},
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.LITERAL, Value: '2'},
+			},
+		},
+
 		// *
 		{
 			pattern: "a*",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 0,
 					Max: parser.INFINITY,
@@ -247,9 +578,9 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "ba*",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('b')},
+				{Type: token.LITERAL, Value: 'b'},
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 0,
 					Max: parser.INFINITY,
@@ -262,20 +593,19 @@ func TestParser(t *testing.T) {
 				{Type: token.REPEAT, Value: parser.RepeatValue{
 					RepeatToken: token.Token{
 						Type: token.GROUP,
-						Value: []token.Token{
-							{
-								Type: token.OR,
-								Value: []token.Token{
-									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-										{Type: token.BRACKET, Value: map[byte]bool{
-											byte('a'): true,
-											byte('b'): true,
-											byte('c'): true,
+						Value: parser.GroupValue{
+							Index: 1,
+							Tokens: []token.Token{
+								{
+									Type: token.OR,
+									Value: []token.Token{
+										{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+											{Type: token.BRACKET, Value: parser.BracketValue{Ranges: []parser.RuneRange{{Lo: 'a', Hi: 'c'}}}},
 										}},
-									}},
-									{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
-										{Type: token.LITERAL, Value: byte('z')},
-									}},
+										{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+											{Type: token.LITERAL, Value: 'z'},
+										}},
+									},
 								},
 							},
 						},
@@ -287,12 +617,26 @@ func TestParser(t *testing.T) {
 			},
 		},
 
+		{
+			pattern: "a*?b",
+			tokens: []token.Token{
+				{Type: token.REPEAT, Value: parser.RepeatValue{
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
+
+					Min:  0,
+					Max:  parser.INFINITY,
+					Lazy: true,
+				}},
+				{Type: token.LITERAL, Value: 'b'},
+			},
+		},
+
 		// +
 		{
 			pattern: "a+",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 1,
 					Max: parser.INFINITY,
@@ -302,9 +646,9 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "ba+",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('b')},
+				{Type: token.LITERAL, Value: 'b'},
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 1,
 					Max: parser.INFINITY,
@@ -315,12 +659,194 @@ func TestParser(t *testing.T) {
 			pattern: "a+c",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 1,
 					Max: parser.INFINITY,
 				}},
-				{Type: token.LITERAL, Value: byte('c')},
+				{Type: token.LITERAL, Value: 'c'},
+			},
+		},
+
+		{
+			pattern: "a+?",
+			tokens: []token.Token{
+				{Type: token.REPEAT, Value: parser.RepeatValue{
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
+
+					Min:  1,
+					Max:  parser.INFINITY,
+					Lazy: true,
+				}},
+			},
+		},
+
+		{
+			pattern: "a++b",
+			tokens: []token.Token{
+				{Type: token.POSSESSIVE_REPEAT, Value: parser.RepeatValue{
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
+
+					Min: 1,
+					Max: parser.INFINITY,
+				}},
+				{Type: token.LITERAL, Value: 'b'},
+			},
+		},
+		{
+			pattern: "(?>ab)",
+			tokens: []token.Token{
+				{Type: token.ATOMIC_GROUP, Value: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+					{Type: token.LITERAL, Value: 'b'},
+				}},
+			},
+		},
+		{
+			pattern: "(?=a)",
+			tokens: []token.Token{
+				{Type: token.LOOKAHEAD, Value: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}},
+			},
+		},
+		{
+			pattern: "(?!a)",
+			tokens: []token.Token{
+				{Type: token.NEGATIVE_LOOKAHEAD, Value: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}},
+			},
+		},
+		{
+			pattern: "(?<=a)",
+			tokens: []token.Token{
+				{Type: token.LOOKBEHIND, Value: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}},
+			},
+		},
+		{
+			pattern: "(?<!a)",
+			tokens: []token.Token{
+				{Type: token.NEGATIVE_LOOKBEHIND, Value: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}},
+			},
+		},
+		{
+			pattern: `(a)\1`,
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+				{Type: token.BACKREFERENCE, Value: 1},
+			},
+		},
+		{
+			pattern: `(?<q>a)\k<q>`,
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Name: "q", Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+				{Type: token.BACKREFERENCE, Value: 1},
+			},
+		},
+		{
+			pattern: `(a)(?(1)b|c)`,
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+				{Type: token.CONDITIONAL, Value: parser.ConditionalValue{
+					Index: 1,
+					Yes: token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+						{Type: token.LITERAL, Value: 'b'},
+					}},
+					No: token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+						{Type: token.LITERAL, Value: 'c'},
+					}},
+				}},
+			},
+		},
+		{
+			pattern: `(?<q>a)(?(<q>)b)`,
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Name: "q", Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+				{Type: token.CONDITIONAL, Value: parser.ConditionalValue{
+					Index: 1,
+					Yes: token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+						{Type: token.LITERAL, Value: 'b'},
+					}},
+					No: token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{}},
+				}},
+			},
+		},
+		{
+			pattern: `(?(<q>)b)(?<q>a)`,
+			tokens: []token.Token{
+				{Type: token.CONDITIONAL, Value: parser.ConditionalValue{
+					Index: 1,
+					Yes: token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{
+						{Type: token.LITERAL, Value: 'b'},
+					}},
+					No: token.Token{Type: token.UNCAPTURE_GROUP, Value: []token.Token{}},
+				}},
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Name: "q", Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+			},
+		},
+		{
+			pattern: `a(?R)?b`,
+			tokens: []token.Token{
+				{Type: token.LITERAL, Value: 'a'},
+				{Type: token.REPEAT, Value: parser.RepeatValue{
+					RepeatToken: token.Token{Type: token.SUBROUTINE, Value: 0},
+
+					Min: 0,
+					Max: 1,
+				}},
+				{Type: token.LITERAL, Value: 'b'},
+			},
+		},
+		{
+			pattern: `(?<x>a)(?1)(?&x)(?P>x)`,
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Name: "x", Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+				{Type: token.SUBROUTINE, Value: 1},
+				{Type: token.SUBROUTINE, Value: 1},
+				{Type: token.SUBROUTINE, Value: 1},
+			},
+		},
+		{
+			pattern: `(?&x)(?1)(?<x>a)`,
+			tokens: []token.Token{
+				{Type: token.SUBROUTINE, Value: 1},
+				{Type: token.SUBROUTINE, Value: 1},
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Name: "x", Tokens: []token.Token{
+					{Type: token.LITERAL, Value: 'a'},
+				}}},
+			},
+		},
+		{
+			pattern: "(12)",
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Tokens: []token.Token{
+					{Type: token.LITERAL, Value: '1'},
+					{Type: token.LITERAL, Value: '2'},
+				}}},
+			},
+		},
+		{
+			pattern: "()1",
+			tokens: []token.Token{
+				{Type: token.GROUP, Value: parser.GroupValue{Index: 1, Tokens: []token.Token{}}},
+				{Type: token.LITERAL, Value: '1'},
 			},
 		},
 
@@ -329,7 +855,7 @@ func TestParser(t *testing.T) {
 			pattern: "a?",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 0,
 					Max: 1,
@@ -339,9 +865,9 @@ func TestParser(t *testing.T) {
 		{
 			pattern: "ba?",
 			tokens: []token.Token{
-				{Type: token.LITERAL, Value: byte('b')},
+				{Type: token.LITERAL, Value: 'b'},
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 0,
 					Max: 1,
@@ -352,19 +878,36 @@ func TestParser(t *testing.T) {
 			pattern: "a?c",
 			tokens: []token.Token{
 				{Type: token.REPEAT, Value: parser.RepeatValue{
-					RepeatToken: token.Token{Type: token.LITERAL, Value: byte('a')},
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
 
 					Min: 0,
 					Max: 1,
 				}},
-				{Type: token.LITERAL, Value: byte('c')},
+				{Type: token.LITERAL, Value: 'c'},
+			},
+		},
+		{
+			pattern: "a??",
+			tokens: []token.Token{
+				{Type: token.REPEAT, Value: parser.RepeatValue{
+					RepeatToken: token.Token{Type: token.LITERAL, Value: 'a'},
+
+					Min:  0,
+					Max:  1,
+					Lazy: true,
+				}},
 			},
 		},
 	}
 
 	for _, test := range testcases {
 		t.Run(fmt.Sprintf("Test for: %s", test.pattern), func(t *testing.T) {
-			tokens := parser.Parse(test.pattern).GetTokens()
+			ctx, err := parser.Parse(test.pattern)
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %v", test.pattern, err)
+			}
+
+			tokens := ctx.GetTokens()
 
 			if len(tokens) != len(test.tokens) {
 				t.Logf("Expected %v, got %v", test.tokens, tokens)
@@ -385,3 +928,301 @@ func TestParser(t *testing.T) {
 		})
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	testcases := []struct {
+		pattern  string
+		kind     parser.ErrorKind
+		pos      int
+		fragment string
+	}{
+		{pattern: "(abc", kind: parser.UNCLOSED_GROUP, pos: 0, fragment: "(abc"},
+		{pattern: "a(b(c)", kind: parser.UNCLOSED_GROUP, pos: 1, fragment: "(b(c)"},
+		{pattern: "ab)", kind: parser.UNMATCHED_PAREN, pos: 2, fragment: ")"},
+		{pattern: "a|b)", kind: parser.UNMATCHED_PAREN, pos: 3, fragment: ")"},
+		{pattern: "x[abc", kind: parser.UNCLOSED_BRACKET, pos: 1, fragment: "[abc"},
+		{pattern: "[]", kind: parser.UNCLOSED_BRACKET, pos: 0, fragment: "[]"},
+		{pattern: "[^]", kind: parser.UNCLOSED_BRACKET, pos: 0, fragment: "[^]"},
+		{pattern: "[az-a]", kind: parser.BAD_RANGE, pos: 2, fragment: "z-a"},
+		{pattern: `[a-\d]`, kind: parser.BAD_RANGE, pos: 1, fragment: `a-\d`},
+		{pattern: "[[:alpah:]]", kind: parser.UNKNOWN_CLASS, pos: 1, fragment: "[:alpah:]"},
+		{pattern: "[a[:^Digit:]]", kind: parser.UNKNOWN_CLASS, pos: 2, fragment: "[:^Digit:]"},
+		{pattern: `[\x7a-\x61]b`, kind: parser.BAD_RANGE, pos: 1, fragment: `\x7a-\x61`},
+		{pattern: "a{3,2}", kind: parser.BAD_REPEAT, pos: 1, fragment: "{3,2}"},
+		{pattern: "a{1001}", kind: parser.REPEAT_TOO_LARGE, pos: 1, fragment: "{1001}"},
+		{pattern: "a{2,99999999999999999999}", kind: parser.REPEAT_TOO_LARGE, pos: 1, fragment: "{2,99999999999999999999}"},
+		{pattern: "a**", kind: parser.NESTED_QUANTIFIER, pos: 2, fragment: "*"},
+		{pattern: "a+?+", kind: parser.NESTED_QUANTIFIER, pos: 3, fragment: "+"},
+		{pattern: "a{2}{3}", kind: parser.NESTED_QUANTIFIER, pos: 4, fragment: "{3}"},
+		{pattern: "*a", kind: parser.DANGLING_QUANTIFIER, pos: 0, fragment: "*"},
+		{pattern: "a|+", kind: parser.DANGLING_QUANTIFIER, pos: 2, fragment: "+"},
+		{pattern: "(+)", kind: parser.DANGLING_QUANTIFIER, pos: 1, fragment: "+"},
+		{pattern: "(?)", kind: parser.BAD_FLAGS, pos: 0, fragment: "(?)"},
+		{pattern: "a(?mq)", kind: parser.BAD_FLAGS, pos: 4, fragment: "q"},
+		{pattern: "(?m", kind: parser.UNCLOSED_GROUP, pos: 0, fragment: "(?m"},
+		{pattern: "(?i-)", kind: parser.BAD_FLAGS, pos: 0, fragment: "(?i-)"},
+		{pattern: "(?-:a)", kind: parser.BAD_FLAGS, pos: 0, fragment: "(?-:"},
+		{pattern: "(?i-m-s)", kind: parser.BAD_FLAGS, pos: 5, fragment: "-"},
+		{pattern: "(?i:a", kind: parser.UNCLOSED_GROUP, pos: 0, fragment: "(?i:a"},
+		{pattern: "a(?#note", kind: parser.UNCLOSED_COMMENT, pos: 1, fragment: "(?#note"},
+		{pattern: "(?x)(a#)", kind: parser.UNCLOSED_GROUP, pos: 4, fragment: "(a#)"},
+		{pattern: "(?:a", kind: parser.UNCLOSED_GROUP, pos: 0, fragment: "(?:a"},
+		{pattern: "(?P<1st>a)", kind: parser.BAD_GROUP_NAME, pos: 4, fragment: "1st"},
+		{pattern: "(?<a-b>a)", kind: parser.BAD_GROUP_NAME, pos: 3, fragment: "a-b"},
+		{pattern: "(?P<>a)", kind: parser.BAD_GROUP_NAME, pos: 4, fragment: ""},
+		{pattern: "(?P<name", kind: parser.BAD_GROUP_NAME, pos: 4, fragment: "name"},
+		{pattern: "(?P<x>a)(?<x>b)", kind: parser.DUPLICATE_GROUP_NAME, pos: 11, fragment: "x"},
+		{pattern: "(?:a{1000}){1000}", kind: parser.REPEAT_TOO_LARGE, pos: 11, fragment: "{1000}"},
+		{pattern: "((a{10}|b){10}c){11}", kind: parser.REPEAT_TOO_LARGE, pos: 16, fragment: "{11}"},
+		{pattern: "{2}x", kind: parser.DANGLING_QUANTIFIER, pos: 0, fragment: "{2}"},
+		{pattern: `ab\`, kind: parser.TRAILING_BACKSLASH, pos: 2, fragment: `\`},
+		{pattern: `\x4g`, kind: parser.BAD_ESCAPE, pos: 0, fragment: `\x4g`},
+		{pattern: `a\x4`, kind: parser.BAD_ESCAPE, pos: 1, fragment: `\x4`},
+		{pattern: `\q`, kind: parser.UNKNOWN_ESCAPE, pos: 0, fragment: `\q`},
+		{pattern: `[a\q]`, kind: parser.UNKNOWN_ESCAPE, pos: 2, fragment: `\q`},
+		{pattern: `\x{110000}`, kind: parser.BAD_ESCAPE, pos: 0, fragment: `\x{110000}`},
+		{pattern: `a\p{Klingon}`, kind: parser.UNKNOWN_PROPERTY, pos: 1, fragment: `\p{Klingon}`},
+		{pattern: `[\pX]`, kind: parser.UNKNOWN_PROPERTY, pos: 1, fragment: `\pX`},
+		{pattern: `\p{L`, kind: parser.UNKNOWN_PROPERTY, pos: 0, fragment: `\p{L`},
+		{pattern: `\P`, kind: parser.UNKNOWN_PROPERTY, pos: 0, fragment: `\P`},
+		{pattern: `\x{D800}`, kind: parser.BAD_ESCAPE, pos: 0, fragment: `\x{D800}`},
+		{pattern: `[\x{41]`, kind: parser.BAD_ESCAPE, pos: 1, fragment: `\x{41]`},
+		{pattern: "a\xffb", kind: parser.INVALID_UTF8, pos: 1, fragment: "\xff"},
+		{pattern: "[\xe9]", kind: parser.INVALID_UTF8, pos: 1, fragment: "\xe9"},
+		{pattern: `(a)\2`, kind: parser.UNKNOWN_GROUP, pos: 3, fragment: `\2`},
+		{pattern: `\1(a)`, kind: parser.UNKNOWN_GROUP, pos: 0, fragment: `\1`},
+		{pattern: `(?<a>x)\k<b>`, kind: parser.UNKNOWN_GROUP, pos: 7, fragment: `\k<b>`},
+		{pattern: `(?<a>x)\k<a`, kind: parser.BAD_GROUP_NAME, pos: 10, fragment: "a"},
+		{pattern: `\ka`, kind: parser.BAD_GROUP_NAME, pos: 0, fragment: `\ka`},
+		{pattern: `(a)(?(2)b)`, kind: parser.UNKNOWN_GROUP, pos: 6, fragment: "2"},
+		{pattern: `(?(2)b)(a)`, kind: parser.UNKNOWN_GROUP, pos: 3, fragment: "2"},
+		{pattern: `(a)(?(<b>)b)`, kind: parser.UNKNOWN_GROUP, pos: 6, fragment: "<b>"},
+		{pattern: `(a)(?(?=a)b)`, kind: parser.BAD_CONDITIONAL, pos: 6, fragment: "?=a"},
+		{pattern: `(a)(?(1)b|c|d)`, kind: parser.BAD_CONDITIONAL, pos: 3, fragment: "(?(1)b|c|d)"},
+		{pattern: `(a)(?(1)b`, kind: parser.UNCLOSED_GROUP, pos: 3, fragment: "(?(1)b"},
+		{pattern: `(a)(?2)`, kind: parser.UNKNOWN_GROUP, pos: 5, fragment: "2"},
+		{pattern: `(?1)(?2)(a)`, kind: parser.UNKNOWN_GROUP, pos: 6, fragment: "2"},
+		{pattern: `(?&x)`, kind: parser.UNKNOWN_GROUP, pos: 3, fragment: "x"},
+		{pattern: `(?&1x)`, kind: parser.BAD_GROUP_NAME, pos: 3, fragment: "1x"},
+		{pattern: `a(?R`, kind: parser.UNCLOSED_GROUP, pos: 1, fragment: "(?R"},
+	}
+
+	for _, test := range testcases {
+		t.Run(fmt.Sprintf("Test for: %s", test.pattern), func(t *testing.T) {
+			_, err := parser.Parse(test.pattern)
+
+			var parseErr *parser.ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected *ParseError, got %v", err)
+			}
+
+			if parseErr.Kind != test.kind || parseErr.Pos != test.pos || parseErr.Fragment != test.fragment {
+				t.Logf("Expected %s at %d (%q), got %s at %d (%q)",
+					test.kind, test.pos, test.fragment, parseErr.Kind, parseErr.Pos, parseErr.Fragment)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestParseErrorRecovery(t *testing.T) {
+	testcases := []struct {
+		pattern string
+		kinds   []parser.ErrorKind
+		pos     []int
+	}{
+		{
+			pattern: "a|*b",
+			kinds:   []parser.ErrorKind{parser.DANGLING_QUANTIFIER},
+			pos:     []int{2},
+		},
+		{
+			pattern: "*a{3,2}b)",
+			kinds:   []parser.ErrorKind{parser.DANGLING_QUANTIFIER, parser.BAD_REPEAT, parser.UNMATCHED_PAREN},
+			pos:     []int{0, 2, 8},
+		},
+		{
+			pattern: "[z-a]b|[c-a]|*",
+			kinds:   []parser.ErrorKind{parser.BAD_RANGE, parser.BAD_RANGE, parser.DANGLING_QUANTIFIER},
+			pos:     []int{1, 8, 13},
+		},
+		{
+			pattern: "(a|+[bc",
+			kinds:   []parser.ErrorKind{parser.UNCLOSED_GROUP, parser.DANGLING_QUANTIFIER, parser.UNCLOSED_BRACKET},
+			pos:     []int{0, 3, 4},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(fmt.Sprintf("Test for: %s", test.pattern), func(t *testing.T) {
+			_, err := parser.Parse(test.pattern)
+
+			var parseErrs *parser.ParseErrors
+			if !errors.As(err, &parseErrs) {
+				t.Fatalf("Expected *ParseErrors, got %v", err)
+			}
+
+			if len(parseErrs.Errors) != len(test.kinds) {
+				t.Fatalf("Expected %d errors, got %d:\n%v", len(test.kinds), len(parseErrs.Errors), err)
+			}
+
+			for idx, parseErr := range parseErrs.Errors {
+				if parseErr.Kind != test.kinds[idx] || parseErr.Pos != test.pos[idx] {
+					t.Logf("Expected %s at %d, got %s at %d", test.kinds[idx], test.pos[idx], parseErr.Kind, parseErr.Pos)
+					t.Fail()
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrorDiagnostic(t *testing.T) {
+	_, err := parser.Parse("a|*b{3,2}")
+
+	expected := "error: dangling quantifier at offset 2\n" +
+		"    a|*b{3,2}\n" +
+		"      ^ quantifier '*' has nothing to repeat\n" +
+		"error: bad repeat count at offset 4\n" +
+		"    a|*b{3,2}\n" +
+		"        ^~~~~ the minimum of '{3,2}' is above its maximum"
+
+	if err == nil || err.Error() != expected {
+		t.Logf("Expected:\n%s\ngot:\n%v", expected, err)
+		t.Fail()
+	}
+
+	// columns count characters, not bytes
+	_, err = parser.Parse("ça)")
+
+	expected = "error: unmatched closing parenthesis at offset 3\n" +
+		"    ça)\n" +
+		"      ^ ')' has no matching '('"
+
+	if err == nil || err.Error() != expected {
+		t.Logf("Expected:\n%s\ngot:\n%v", expected, err)
+		t.Fail()
+	}
+}
+
+func TestParseUnknownGroupHint(t *testing.T) {
+	tests := []struct {
+		pattern string
+		hint    string
+	}{
+		{pattern: `\1(a)`, hint: `'\1' refers to a group the pattern does not have; backreferences must follow their group`},
+		{pattern: `(a)\k<b>`, hint: `'\k<b>' refers to a group the pattern does not have; backreferences must follow their group`},
+		{pattern: `(?(2)b)(a)`, hint: `'2' refers to a group the pattern does not have`},
+		{pattern: `(a)(?2)`, hint: `'2' refers to a group the pattern does not have`},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s]", tt.pattern), func(t *testing.T) {
+			_, err := parser.Parse(tt.pattern)
+
+			var parseErr *parser.ParseError
+			if !errors.As(err, &parseErr) || parseErr.Kind != parser.UNKNOWN_GROUP || parseErr.Hint != tt.hint {
+				t.Logf("Expected %s with hint %q, got %v", parser.UNKNOWN_GROUP, tt.hint, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	ctx, err := parser.ParseWithOptions("^$", parser.Options{Flags: token.FLAG_MULTILINE})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if tokens := ctx.GetTokens(); tokens[0].Type != token.BEGIN_LINE || tokens[1].Type != token.END_LINE {
+		t.Logf("Expected line anchors, got %v", tokens)
+		t.Fail()
+	}
+
+	ctx, err = parser.ParseWithOptions("(.)", parser.Options{Flags: token.FLAG_DOT_NL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	group := ctx.GetTokens()[0].Value.(parser.GroupValue).Tokens
+
+	if group[0].Type != token.ANY || group[0].Flags&token.FLAG_DOT_NL == 0 {
+		t.Logf("Expected ANY with FLAG_DOT_NL, got %v", group[0])
+		t.Fail()
+	}
+
+	ctx, err = parser.Parse("(?i)a(?-i)b((?i)c)d(?i:e)f")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tokens := ctx.GetTokens()
+	literals := []token.Token{
+		tokens[0],
+		tokens[1],
+		tokens[2].Value.(parser.GroupValue).Tokens[0],
+		tokens[3],
+		tokens[4].Value.([]token.Token)[0],
+		tokens[5],
+	}
+
+	for i, literal := range literals {
+		folded := literal.Flags&token.FLAG_CASE_INSENSITIVE != 0
+		if folded != (i%2 == 0) {
+			t.Logf("Expected FLAG_CASE_INSENSITIVE %t on %q, got %v", i%2 == 0, literal.Value, literal)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseMaxRepeat(t *testing.T) {
+	_, err := parser.ParseWithOptions("a{5}", parser.Options{MaxRepeat: 4})
+
+	var parseErr *parser.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Kind != parser.REPEAT_TOO_LARGE || parseErr.Hint != "repeat counts must be at most 4" {
+		t.Logf("Expected %s, got %v", parser.REPEAT_TOO_LARGE, err)
+		t.Fail()
+	}
+
+	ctx, err := parser.ParseWithOptions("a{1,2000}", parser.Options{MaxRepeat: 2000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rep := ctx.GetTokens()[0].Value.(parser.RepeatValue); rep.Max != 2000 {
+		t.Logf("Expected a max of 2000, got %v", rep)
+		t.Fail()
+	}
+
+	if _, err := parser.ParseWithOptions("(?:a{40}){50}", parser.Options{MaxRepeat: 2000}); err != nil {
+		t.Logf("Unexpected error: %v", err)
+		t.Fail()
+	}
+}
+
+func TestParseSubexpNames(t *testing.T) {
+	ctx, err := parser.Parse("(a)(?:b)(?P<year>c(d))")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"", "", "year", ""}
+
+	if names := ctx.GetSubexpNames(); !reflect.DeepEqual(names, expected) {
+		t.Logf("Expected %q, got %q", expected, names)
+		t.Fail()
+	}
+}
+
+// tableRanges lists every rune of the table as its own range.
+func tableRanges(table *unicode.RangeTable) []parser.RuneRange {
+	var ranges []parser.RuneRange
+
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		if unicode.Is(table, r) {
+			ranges = append(ranges, parser.RuneRange{Lo: r, Hi: r})
+		}
+	}
+
+	return ranges
+}
@@ -2,8 +2,12 @@ package regex_test
 
 import (
 	"fmt"
+	"reflect"
+	"regex-engine/internals/fsm"
 	"regex-engine/internals/regex"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRegex(t *testing.T) {
@@ -37,9 +41,14 @@ func TestRegex(t *testing.T) {
 		// group expressions
 		{
 			pattern: "(abc)",
-			input:   "a",
+			input:   "abc",
 			match:   true,
 		},
+		{
+			pattern: "(abc)",
+			input:   "a",
+			match:   false,
+		},
 		{
 			pattern: "(abc)",
 			input:   "da",
@@ -47,9 +56,14 @@ func TestRegex(t *testing.T) {
 		},
 		{
 			pattern: "a(cd)",
-			input:   "ac",
+			input:   "acd",
 			match:   true,
 		},
+		{
+			pattern: "a(cd)",
+			input:   "ac",
+			match:   false,
+		},
 		{
 			pattern: "a(cd)",
 			input:   "cd",
@@ -72,13 +86,68 @@ func TestRegex(t *testing.T) {
 			input:   "cb",
 			match:   true,
 		},
+		{
+			pattern: "a|(bcd)",
+			input:   "bcd",
+			match:   true,
+		},
 		{
 			pattern: "a|(bcd)",
 			input:   "d",
+			match:   false,
+		},
+		{
+			pattern: "a|b|c",
+			input:   "c",
+			match:   true,
+		},
+		{
+			pattern: "ab|cd|ef",
+			input:   "cd",
+			match:   true,
+		},
+		{
+			pattern: "ab|cd|ef",
+			input:   "ad",
+			match:   false,
+		},
+		{
+			pattern: "x(ab|cd)y",
+			input:   "xcdy",
+			match:   true,
+		},
+		{
+			pattern: "a|",
+			input:   "",
+			match:   true,
+		},
+		{
+			pattern: "(|a)b",
+			input:   "ab",
+			match:   true,
+		},
+		{
+			pattern: "(ab)+",
+			input:   "ababab",
+			match:   true,
+		},
+		{
+			pattern: "(ab)+",
+			input:   "abba",
+			match:   false,
+		},
+		{
+			pattern: "(?:ab)*c",
+			input:   "ababc",
+			match:   true,
+		},
+		{
+			pattern: "x(?:a(b|c)d)?",
+			input:   "xacd",
 			match:   true,
 		},
 
-        // bracket
+		// bracket
 		{
 			pattern: "[abc]",
 			input:   "a",
@@ -100,7 +169,127 @@ func TestRegex(t *testing.T) {
 			match:   false,
 		},
 
-        // *
+		{
+			pattern: "[^abc]",
+			input:   "d",
+			match:   true,
+		},
+		{
+			pattern: "[^abc]",
+			input:   "b",
+			match:   false,
+		},
+		{
+			pattern: "[^a-z]+",
+			input:   "AB\n09",
+			match:   true,
+		},
+		{
+			pattern: "[]x]+",
+			input:   "]x]",
+			match:   true,
+		},
+		{
+			pattern: "[a-]+",
+			input:   "a-a",
+			match:   true,
+		},
+		{
+			pattern: "[-a]",
+			input:   "b",
+			match:   false,
+		},
+
+		// shorthand classes
+		{
+			pattern: `\d+`,
+			input:   "2024",
+			match:   true,
+		},
+		{
+			pattern: `\d+`,
+			input:   "20x4",
+			match:   false,
+		},
+		{
+			pattern: `\w+\s\w+`,
+			input:   "snake_case\tCamel9",
+			match:   true,
+		},
+		{
+			pattern: `\D\W\S`,
+			input:   "a-b",
+			match:   true,
+		},
+		{
+			pattern: `\D`,
+			input:   "5",
+			match:   false,
+		},
+		{
+			pattern: `[\d_-]+`,
+			input:   "2024-01_02",
+			match:   true,
+		},
+		{
+			pattern: `[^\s]+`,
+			input:   "no space",
+			match:   false,
+		},
+		{
+			pattern: `[\W\d]+`,
+			input:   "+1 (555)",
+			match:   true,
+		},
+
+		// POSIX classes
+		{
+			pattern: "[[:upper:]][[:lower:]]+",
+			input:   "Hello",
+			match:   true,
+		},
+		{
+			pattern: "[[:upper:]][[:lower:]]+",
+			input:   "hello",
+			match:   false,
+		},
+		{
+			pattern: "[[:alpha:][:digit:]_]+",
+			input:   "abc_123",
+			match:   true,
+		},
+		{
+			pattern: "[[:punct:]]+",
+			input:   "!?.,;",
+			match:   true,
+		},
+		{
+			pattern: "[[:punct:]]",
+			input:   "a",
+			match:   false,
+		},
+		{
+			pattern: "[[:space:]]+[[:xdigit:]]+",
+			input:   " \t\nBeEf09",
+			match:   true,
+		},
+		{
+			pattern: "[[:^alpha:]]+",
+			input:   "123 !",
+			match:   true,
+		},
+		{
+			pattern: "[[:^alpha:]]",
+			input:   "q",
+			match:   false,
+		},
+		{
+			pattern: "[^[:cntrl:]]",
+			input:   "\x7f",
+			match:   false,
+		},
+
+		// *
 		{
 			pattern: "a*",
 			input:   "aaaaaaaaaaaaaaaaaaaaa",
@@ -117,7 +306,7 @@ func TestRegex(t *testing.T) {
 			match:   true,
 		},
 
-        // +
+		// +
 		{
 			pattern: "a+",
 			input:   "aaaaaaaaaaaaaaaaaaaaa",
@@ -134,7 +323,7 @@ func TestRegex(t *testing.T) {
 			match:   false,
 		},
 
-        // ?
+		// ?
 		{
 			pattern: "a?",
 			input:   "",
@@ -151,32 +340,1168 @@ func TestRegex(t *testing.T) {
 			match:   false,
 		},
 
-        // {
+		// escapes
 		{
-			pattern: "a{,3}",
-			input:   "aaaa",
+			pattern: `a\+`,
+			input:   "a+",
+			match:   true,
+		},
+		{
+			pattern: `a\+`,
+			input:   "aa",
 			match:   false,
 		},
 		{
-			pattern: "([ab-c]|z){1,2}",
-			input:   "zz",
+			pattern: `\(\[\{\|\*\?\\`,
+			input:   `([{|*?\`,
 			match:   true,
 		},
 		{
-			pattern: "([ab-c]|z)*ab{0,1}c",
-			input:   "zzzzzzzzzzzzzzzzzabbc",
+			pattern: `a\nb\t\x41`,
+			input:   "a\nb\tA",
+			match:   true,
+		},
+		{
+			pattern: `\0\x01\x02`,
+			input:   "\x00\x01\x02",
+			match:   true,
+		},
+		{
+			pattern: `[\*\-]+`,
+			input:   "*-*",
+			match:   true,
+		},
+		{
+			pattern: `[\x00-\x1f]`,
+			input:   "\x1b",
+			match:   true,
+		},
+
+		// dot
+		{
+			pattern: "a.c",
+			input:   "abc",
+			match:   true,
+		},
+		{
+			pattern: "a.c",
+			input:   "ac",
+			match:   false,
+		},
+		{
+			pattern: "a.c",
+			input:   "a\nc",
+			match:   false,
+		},
+		{
+			pattern: ".*",
+			input:   "any thing\x00",
+			match:   true,
+		},
+		{
+			pattern: `a\.c`,
+			input:   "abc",
 			match:   false,
 		},
-	}
 
-	for _, tt := range tests {
-		t.Run(fmt.Sprintf("Test for: [%s] on [%s]", tt.pattern, tt.input), func(t *testing.T) {
-			actual := regex.Match(tt.input, tt.pattern)
+		// anchors
+		{
+			pattern: "^abc$",
+			input:   "abc",
+			match:   true,
+		},
+		{
+			pattern: `\Aa*\z`,
+			input:   "aaa",
+			match:   true,
+		},
+		{
+			pattern: "a^b",
+			input:   "ab",
+			match:   false,
+		},
 
-			if actual != tt.match {
-				t.Logf("Expected %t, got %t: [%s] on [%s]", tt.match, actual, tt.pattern, tt.input)
-				t.Fail()
-			}
-		})
+		// lazy repeats only change which match is reported
+		{
+			pattern: "a*?b",
+			input:   "aaab",
+			match:   true,
+		},
+		{
+			pattern: "a{1,2}?",
+			input:   "aa",
+			match:   true,
+		},
+
+		// possessive repeats and atomic groups never give back
+		{
+			pattern: "a*a",
+			input:   "aaa",
+			match:   true,
+		},
+		{
+			pattern: "a*+a",
+			input:   "aaa",
+			match:   false,
+		},
+		{
+			pattern: "a*+b",
+			input:   "aaab",
+			match:   true,
+		},
+		{
+			pattern: `\d++\d`,
+			input:   "123",
+			match:   false,
+		},
+		{
+			pattern: "a?+a",
+			input:   "a",
+			match:   false,
+		},
+		{
+			pattern: "a{1,3}+a",
+			input:   "aaa",
+			match:   false,
+		},
+		{
+			pattern: "a{1,3}+a",
+			input:   "aaaa",
+			match:   true,
+		},
+		{
+			pattern: `"[^"]*+"`,
+			input:   `"quoted"`,
+			match:   true,
+		},
+		{
+			pattern: "(a|ab)c",
+			input:   "abc",
+			match:   true,
+		},
+		{
+			pattern: "(?>a|ab)c",
+			input:   "abc",
+			match:   false,
+		},
+		{
+			pattern: "(?>ab|a)c",
+			input:   "abc",
+			match:   true,
+		},
+		{
+			pattern: "(?>x+)y",
+			input:   "xxxy",
+			match:   true,
+		},
+
+		// lookaround checks without consuming input
+		{
+			pattern: "(?=.*\\d)(?=.*[a-z]).{6,}",
+			input:   "secret1",
+			match:   true,
+		},
+		{
+			pattern: "(?=.*\\d)(?=.*[a-z]).{6,}",
+			input:   "secret",
+			match:   false,
+		},
+		{
+			pattern: "(?=.*\\d)(?=.*[a-z]).{6,}",
+			input:   "s3c",
+			match:   false,
+		},
+		{
+			pattern: "foo(?!bar).*",
+			input:   "foobaz",
+			match:   true,
+		},
+		{
+			pattern: "foo(?!bar).*",
+			input:   "foobar",
+			match:   false,
+		},
+		{
+			pattern: "(?=abc)ab",
+			input:   "ab",
+			match:   false,
+		},
+		{
+			pattern: "a(?<=a)b",
+			input:   "ab",
+			match:   true,
+		},
+		{
+			pattern: "a(?<!a)b",
+			input:   "ab",
+			match:   false,
+		},
+		{
+			pattern: "(?<=^x*)y",
+			input:   "y",
+			match:   true,
+		},
+
+		// backreferences
+		{
+			pattern: `(a|b)\1`,
+			input:   "bb",
+			match:   true,
+		},
+		{
+			pattern: `(a|b)\1`,
+			input:   "ab",
+			match:   false,
+		},
+		{
+			pattern: `(a*)b\1`,
+			input:   "aabaa",
+			match:   true,
+		},
+		{
+			pattern: `(a*)b\1`,
+			input:   "aaba",
+			match:   false,
+		},
+		{
+			pattern: `(a)?b\1`,
+			input:   "b",
+			match:   false,
+		},
+		{
+			pattern: `(?<q>["'])[^"']*\k<q>`,
+			input:   `'single'`,
+			match:   true,
+		},
+		{
+			pattern: `(?<q>["'])[^"']*\k<q>`,
+			input:   `'mixed"`,
+			match:   false,
+		},
+		{
+			pattern: `(a*)*\1`,
+			input:   "aa",
+			match:   true,
+		},
+
+		// inline flags
+		{
+			pattern: "(?i)error",
+			input:   "ERROR",
+			match:   true,
+		},
+		{
+			pattern: "(?i)abc(?-i)DEF",
+			input:   "aBcDEF",
+			match:   true,
+		},
+		{
+			pattern: "(?i)abc(?-i)DEF",
+			input:   "abcdef",
+			match:   false,
+		},
+		{
+			pattern: "(?i:a)b",
+			input:   "AB",
+			match:   false,
+		},
+		{
+			pattern: "((?i)a)a",
+			input:   "AA",
+			match:   false,
+		},
+		{
+			pattern: "(?i)a|b",
+			input:   "B",
+			match:   true,
+		},
+		{
+			pattern: "(?i)[a-c]+",
+			input:   "aBC",
+			match:   true,
+		},
+		{
+			pattern: "(?i)[^a-c]",
+			input:   "B",
+			match:   false,
+		},
+		{
+			pattern: `(?i)(a)\1`,
+			input:   "aA",
+			match:   true,
+		},
+		{
+			pattern: "(?s:.)(?-s:.)",
+			input:   "\n\n",
+			match:   false,
+		},
+		{
+			pattern: "(?s:.).",
+			input:   "\na",
+			match:   true,
+		},
+
+		// conditionals
+		{
+			pattern: `(")?[^"]*(?(1)")`,
+			input:   `"quoted"`,
+			match:   true,
+		},
+		{
+			pattern: `(")?[^"]*(?(1)")`,
+			input:   `bare`,
+			match:   true,
+		},
+		{
+			pattern: `(")?[^"]*(?(1)")`,
+			input:   `"half`,
+			match:   false,
+		},
+		{
+			pattern: `(")?[^"]*(?(1)")`,
+			input:   `half"`,
+			match:   false,
+		},
+		{
+			pattern: `(?<paren>\()?\d+(?(<paren>)\)|;)`,
+			input:   "(42)",
+			match:   true,
+		},
+		{
+			pattern: `(?<paren>\()?\d+(?(<paren>)\)|;)`,
+			input:   "42;",
+			match:   true,
+		},
+		{
+			pattern: `(?<paren>\()?\d+(?(<paren>)\)|;)`,
+			input:   "(42;",
+			match:   false,
+		},
+
+		// recursion and subroutine calls
+		{
+			pattern: `\((?:[^()]|(?R))*\)`,
+			input:   "(a(b)(c(d))e)",
+			match:   true,
+		},
+		{
+			pattern: `\((?:[^()]|(?R))*\)`,
+			input:   "(a(b c)",
+			match:   false,
+		},
+		{
+			pattern: `(?<list>\[(?:\d|(?&list))(?:,(?:\d|(?&list)))*\])`,
+			input:   "[1,[2,[3]],4]",
+			match:   true,
+		},
+		{
+			pattern: `(?<list>\[(?:\d|(?&list))(?:,(?:\d|(?&list)))*\])`,
+			input:   "[1,[2,3]",
+			match:   false,
+		},
+		{
+			pattern: `(\d+)-(?1)`,
+			input:   "12-345",
+			match:   true,
+		},
+		{
+			pattern: `(?R)(?R)|a`,
+			input:   "aa",
+			match:   true,
+		},
+		{
+			pattern: `(?1)-(\d+)`,
+			input:   "12-345",
+			match:   true,
+		},
+		{
+			pattern: `(?&n)\.(?<n>\d+)`,
+			input:   "1.05",
+			match:   true,
+		},
+		{
+			pattern: `(?&n)\.(?<n>\d+)`,
+			input:   ".05",
+			match:   false,
+		},
+		{
+			pattern: `(19|20)\d\d`,
+			input:   "1984",
+			match:   true,
+		},
+		{
+			pattern: `(x)(a1)`,
+			input:   "xa1",
+			match:   true,
+		},
+		{
+			pattern: `(x)(a1)`,
+			input:   "xx",
+			match:   false,
+		},
+		{
+			pattern: `()1`,
+			input:   "1",
+			match:   true,
+		},
+
+		// UTF-8
+		{
+			pattern: "é+",
+			input:   "ééé",
+			match:   true,
+		},
+		{
+			pattern: "é+",
+			input:   "é\xa9",
+			match:   false,
+		},
+		{
+			pattern: "[äöü]+",
+			input:   "üöä",
+			match:   true,
+		},
+		{
+			pattern: "[äöü]",
+			input:   "\xc3",
+			match:   false,
+		},
+		{
+			pattern: "[α-ω]+",
+			input:   "λογος",
+			match:   true,
+		},
+		{
+			pattern: "[^a]",
+			input:   "€",
+			match:   true,
+		},
+		{
+			pattern: ".",
+			input:   "😀",
+			match:   true,
+		},
+		{
+			pattern: "..",
+			input:   "€",
+			match:   false,
+		},
+		{
+			pattern: `\x{20AC}\xe9`,
+			input:   "€é",
+			match:   true,
+		},
+
+		// Unicode properties
+		{
+			pattern: `\p{L}+`,
+			input:   "Ñandú",
+			match:   true,
+		},
+		{
+			pattern: `\p{Lu}\p{Ll}+`,
+			input:   "Élan",
+			match:   true,
+		},
+		{
+			pattern: `\p{Lu}`,
+			input:   "é",
+			match:   false,
+		},
+		{
+			pattern: `\p{Greek}+`,
+			input:   "λόγος",
+			match:   true,
+		},
+		{
+			pattern: `\p{Greek}`,
+			input:   "a",
+			match:   false,
+		},
+		{
+			pattern: `\pN+`,
+			input:   "٣4½",
+			match:   true,
+		},
+		{
+			pattern: `\P{N}`,
+			input:   "5",
+			match:   false,
+		},
+		{
+			pattern: `\p{^Greek}`,
+			input:   "a",
+			match:   true,
+		},
+		{
+			pattern: `[\p{Han}\d]+`,
+			input:   "漢字123",
+			match:   true,
+		},
+		{
+			pattern: `[^\p{L}\s]+`,
+			input:   "Жa",
+			match:   false,
+		},
+		{
+			pattern: `\p{Cyrillic}\p{Any}`,
+			input:   "Ж😀",
+			match:   true,
+		},
+
+		// Unicode case folding
+		{
+			pattern: "(?i)k",
+			input:   "\u212A",
+			match:   true,
+		},
+		{
+			pattern: "(?i)\u212A",
+			input:   "k",
+			match:   true,
+		},
+		{
+			pattern: "(?i)[^k]",
+			input:   "\u212A",
+			match:   false,
+		},
+		{
+			pattern: "(?i)[r-t]+",
+			input:   "Rſs",
+			match:   true,
+		},
+		{
+			pattern: `(?i)[\W]`,
+			input:   "k",
+			match:   false,
+		},
+		{
+			pattern: `(?i)[^\W]`,
+			input:   "k",
+			match:   true,
+		},
+		{
+			pattern: `(?i)[\S]`,
+			input:   "s",
+			match:   true,
+		},
+		{
+			pattern: `(?i)[[:^alpha:]]`,
+			input:   "K",
+			match:   false,
+		},
+		{
+			pattern: `(?i)[\P{Ll}]`,
+			input:   "k",
+			match:   false,
+		},
+		{
+			pattern: "(?i)σοφός",
+			input:   "ΣΟΦΌΣ",
+			match:   true,
+		},
+		{
+			pattern: "(?i)σ+",
+			input:   "ςΣσ",
+			match:   true,
+		},
+		{
+			pattern: "(?i)élan",
+			input:   "ÉLAN",
+			match:   true,
+		},
+		{
+			pattern: "(?i)straße",
+			input:   "STRASSE",
+			match:   false,
+		},
+		{
+			pattern: `(?i)\p{Lu}`,
+			input:   "ж",
+			match:   true,
+		},
+		{
+			pattern: `(?i)(ж)\1`,
+			input:   "жЖ",
+			match:   true,
+		},
+		{
+			pattern: `(?i)(k)\1`,
+			input:   "k\u212A",
+			match:   true,
+		},
+		{
+			pattern: `(?i)(\x{212A})\1`,
+			input:   "\u212Ak",
+			match:   true,
+		},
+		{
+			pattern: `(?i)(kk)\1`,
+			input:   "kk\u212AK",
+			match:   true,
+		},
+		{
+			pattern: `(?i)(k)\1`,
+			input:   "kx",
+			match:   false,
+		},
+
+		// each byte of invalid UTF-8 stands for U+FFFD
+		{
+			pattern: "a.b",
+			input:   "a\xffb",
+			match:   true,
+		},
+		{
+			pattern: "a.b",
+			input:   "a\xe2\x82b",
+			match:   false,
+		},
+		{
+			pattern: "a..b",
+			input:   "a\xe2\x82b",
+			match:   true,
+		},
+		{
+			pattern: `\x{FFFD}[^x]`,
+			input:   "\xff\xbf",
+			match:   true,
+		},
+		{
+			pattern: `\x{FFFD}`,
+			input:   "\uFFFD",
+			match:   true,
+		},
+		{
+			pattern: "[a-z]",
+			input:   "\xff",
+			match:   false,
+		},
+
+		// comments and extended mode
+		{
+			pattern: "ab(?#no (nesting)c",
+			input:   "abc",
+			match:   true,
+		},
+		{
+			pattern: "(?x) a + b # trailing comment",
+			input:   "aaab",
+			match:   true,
+		},
+		{
+			pattern: "(?x: a b )c d",
+			input:   "abc d",
+			match:   true,
+		},
+		{
+			pattern: "(?x)a#)\nb",
+			input:   "ab",
+			match:   true,
+		},
+		{
+			pattern: "(?x)[# ]+",
+			input:   " # ",
+			match:   true,
+		},
+		{
+			pattern: "(?x)a\\#b",
+			input:   "a#b",
+			match:   true,
+		},
+
+		// {
+		{
+			pattern: "a{,3}",
+			input:   "aaaa",
+			match:   false,
+		},
+		{
+			pattern: "([ab-c]|z){1,2}",
+			input:   "zz",
+			match:   true,
+		},
+		{
+			pattern: "([ab-c]|z)*ab{0,1}c",
+			input:   "zzzzzzzzzzzzzzzzzabbc",
+			match:   false,
+		},
+		{
+			pattern: "a{,}",
+			input:   "a{,}",
+			match:   true,
+		},
+		{
+			pattern: "x{1,y}",
+			input:   "x{1,y}",
+			match:   true,
+		},
+		{
+			pattern: "{abc",
+			input:   "{abc",
+			match:   true,
+		},
+		{
+			pattern: "a{2",
+			input:   "a{2",
+			match:   true,
+		},
+		{
+			pattern: "(a*)*b",
+			input:   "aab",
+			match:   true,
+		},
+		{
+			pattern: "(?:a{10}){100}",
+			input:   strings.Repeat("a", 1000),
+			match:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s] on [%s]", tt.pattern, tt.input), func(t *testing.T) {
+			actual, err := regex.Match(tt.input, tt.pattern)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			if actual != tt.match {
+				t.Logf("Expected %t, got %t: [%s] on [%s]", tt.match, actual, tt.pattern, tt.input)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestRegexInvalidPattern(t *testing.T) {
+	patterns := []string{"(ab", "[ab", "a{3,2}", "a**", "a{1001}", "(?:a{1000}){1000}", "*", "a)", `a\`, `\xZZ`, "[[:letter:]]"}
+
+	for _, pattern := range patterns {
+		t.Run(fmt.Sprintf("Test for: [%s]", pattern), func(t *testing.T) {
+			matched, err := regex.Match("ab", pattern)
+
+			if err == nil || matched {
+				t.Logf("Expected an error for [%s], got %t, %v", pattern, matched, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestRegexOptions(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		opts    regex.Options
+		match   bool
+	}{
+		{
+			pattern: "a.c",
+			input:   "a\nc",
+			opts:    regex.Options{DotMatchesNewline: true},
+			match:   true,
+		},
+		{
+			pattern: "a.*c",
+			input:   "a\n\nc",
+			opts:    regex.Options{DotMatchesNewline: true},
+			match:   true,
+		},
+		{
+			pattern: "a.*c",
+			input:   "a\n\nc",
+			opts:    regex.Options{},
+			match:   false,
+		},
+		{
+			pattern: "\\d{3} - \\d{4}  # local number\n",
+			input:   "555-0100",
+			opts:    regex.Options{Extended: true},
+			match:   true,
+		},
+		{
+			pattern: "a\\ b [ ]c",
+			input:   "a b c",
+			opts:    regex.Options{Extended: true},
+			match:   true,
+		},
+		{
+			pattern: "a b",
+			input:   "ab",
+			opts:    regex.Options{},
+			match:   false,
+		},
+		{
+			pattern: "error: [a-z]+",
+			input:   "ERROR: Disk",
+			opts:    regex.Options{CaseInsensitive: true},
+			match:   true,
+		},
+		{
+			pattern: "(?-i:E)rror",
+			input:   "error",
+			opts:    regex.Options{CaseInsensitive: true},
+			match:   false,
+		},
+		{
+			pattern: "(abc)",
+			input:   "a",
+			opts:    regex.Options{LegacyGroups: true},
+			match:   true,
+		},
+		{
+			pattern: "a|(bcd)",
+			input:   "d",
+			opts:    regex.Options{LegacyGroups: true},
+			match:   true,
+		},
+		{
+			pattern: "(?:abc)",
+			input:   "abc",
+			opts:    regex.Options{LegacyGroups: true},
+			match:   false,
+		},
+		{
+			pattern: "a{1500}",
+			input:   strings.Repeat("a", 1500),
+			opts:    regex.Options{MaxRepeat: 2000},
+			match:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s] on [%q] with %+v", tt.pattern, tt.input, tt.opts), func(t *testing.T) {
+			r, err := regex.CompileWithOptions(tt.pattern, tt.opts)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			if actual := r.Match(tt.input); actual != tt.match {
+				t.Logf("Expected %t, got %t: [%s] on [%q]", tt.match, actual, tt.pattern, tt.input)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		index   []int
+	}{
+		{pattern: "b", input: "abc", index: []int{1, 2}},
+		{pattern: "^b", input: "abc", index: nil},
+		{pattern: "^a", input: "abc", index: []int{0, 1}},
+		{pattern: "c$", input: "abc", index: []int{2, 3}},
+		{pattern: "b$", input: "abc", index: nil},
+		{pattern: `\Aab`, input: "abab", index: []int{0, 2}},
+		{pattern: `ab\z`, input: "abab", index: []int{2, 4}},
+		{pattern: "^$", input: "", index: []int{0, 0}},
+		{pattern: "x*", input: "abc", index: []int{0, 0}},
+		{pattern: "[0-9]+", input: "abc 123 45", index: []int{4, 7}},
+		{pattern: "(a*)*b", input: "xaab", index: []int{1, 4}},
+		{pattern: "z", input: "abc", index: nil},
+		{pattern: "b|bc|abc", input: "abc", index: []int{0, 3}},
+		{pattern: "c|b|a", input: "abc", index: []int{0, 1}},
+		{pattern: "x(a|ab)", input: "xab", index: []int{0, 2}},
+		{pattern: "a+?", input: "baaa", index: []int{1, 2}},
+		{pattern: "a{2,}?", input: "aaaa", index: []int{0, 2}},
+
+		// an iteration that matches nothing ends the repeat
+		{pattern: "(?:a*?)*", input: "aa", index: []int{0, 0}},
+		{pattern: "(?:|a)*", input: "a", index: []int{0, 0}},
+		{pattern: "(?:a??)*", input: "aa", index: []int{0, 0}},
+		{pattern: "(?:a*)*b", input: "xaab", index: []int{1, 4}},
+
+		// word boundaries
+		{pattern: `\berror\b`, input: "errorCount error", index: []int{11, 16}},
+		{pattern: `\berror\b`, input: "errorCount", index: nil},
+		{pattern: `\berror\b`, input: "(error)", index: []int{1, 6}},
+		{pattern: `\Bcount`, input: "count errorcount", index: []int{11, 16}},
+		{pattern: `\b`, input: "", index: nil},
+		{pattern: `\B`, input: "", index: []int{0, 0}},
+		{pattern: `a\b`, input: "a_b a", index: []int{4, 5}},
+
+		// lookaround
+		{pattern: `(?<=\$)\d+`, input: "5 for $20", index: []int{7, 9}},
+		{pattern: `(?<!-)\b\d`, input: "-1 2", index: []int{3, 4}},
+		{pattern: `\w+(?=:)`, input: "a b: c", index: []int{2, 3}},
+		{pattern: `(?<=ab|b)c`, input: "abc", index: []int{2, 3}},
+		{pattern: `(?<=a.*)z`, input: "xz az", index: []int{4, 5}},
+		{pattern: `(?<=a)`, input: "", index: nil},
+		{pattern: `(?i)(?<=s)x`, input: "ſx", index: []int{2, 3}},
+		{pattern: `(?<=(?i)k)x`, input: "\u212Ax", index: []int{3, 4}},
+
+		// backreferences
+		{pattern: `\b(\w+) \1\b`, input: "it is is fine", index: []int{3, 8}},
+		{pattern: `\b(\w+) \1\b`, input: "is isn't", index: nil},
+		{pattern: `(.)\1`, input: "abccd", index: []int{2, 4}},
+
+		// conditionals
+		{pattern: `(a)?b(?(1)c|d)`, input: "abd", index: []int{1, 3}},
+		{pattern: `(a)?b(?(1)c|d)`, input: "xabc", index: []int{1, 4}},
+		{pattern: `(?(1)x|y)|(a)`, input: "xy", index: []int{1, 2}},
+		{pattern: `(?(1)x|y)|(a)`, input: "xa", index: []int{1, 2}},
+		{pattern: `(?:(?(1)c|a)(b))+`, input: "abcb", index: []int{0, 4}},
+
+		// UTF-8
+		{pattern: "é", input: "café", index: []int{3, 5}},
+		{pattern: "[^a-z]", input: "café", index: []int{3, 5}},
+		{pattern: `\B`, input: "é", index: []int{0, 0}},
+		{pattern: "x*$", input: "é", index: []int{2, 2}},
+		{pattern: ".", input: "\xa9é", index: []int{0, 1}},
+		{pattern: "(?<=é)x", input: "xéx", index: []int{3, 4}},
+		{pattern: `\p{Han}+`, input: "abc漢字x", index: []int{3, 9}},
+		{pattern: `\PL`, input: "añ1", index: []int{3, 4}},
+
+		// recursion
+		{pattern: `\((?:[^()]|(?R))*\)`, input: "f((x) (y)) (", index: []int{1, 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s] on [%s]", tt.pattern, tt.input), func(t *testing.T) {
+			r, err := regex.Compile(tt.pattern)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			if index := r.FindIndex(tt.input); !reflect.DeepEqual(index, tt.index) {
+				t.Logf("Expected %v, got %v: [%s] on [%s]", tt.index, index, tt.pattern, tt.input)
+				t.Fail()
+			}
+
+			if found := r.Search(tt.input); found != (tt.index != nil) {
+				t.Logf("Expected %t, got %t: [%s] on [%s]", tt.index != nil, found, tt.pattern, tt.input)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	input := "key = 1\nname = regex\n"
+
+	tests := []struct {
+		pattern string
+		opts    regex.Options
+		index   []int
+	}{
+		{pattern: "^name", opts: regex.Options{}, index: nil},
+		{pattern: "^name", opts: regex.Options{Multiline: true}, index: []int{8, 12}},
+		{pattern: "(?m)^name", opts: regex.Options{}, index: []int{8, 12}},
+		{pattern: "(?m)1$", opts: regex.Options{}, index: []int{6, 7}},
+		{pattern: "1$", opts: regex.Options{}, index: nil},
+		{pattern: "(?m)regex$", opts: regex.Options{}, index: []int{15, 20}},
+		{pattern: "(?m)^$", opts: regex.Options{}, index: []int{21, 21}},
+		{pattern: `(?m)\Aname`, opts: regex.Options{}, index: nil},
+		{pattern: `(?m)\n\z`, opts: regex.Options{}, index: []int{20, 21}},
+		{pattern: "1.name", opts: regex.Options{}, index: nil},
+		{pattern: "(?s)1.name", opts: regex.Options{}, index: []int{6, 12}},
+		{pattern: "(?sm)1.^name", opts: regex.Options{}, index: []int{6, 12}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s] with %+v", tt.pattern, tt.opts), func(t *testing.T) {
+			r, err := regex.CompileWithOptions(tt.pattern, tt.opts)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			if index := r.FindIndex(input); !reflect.DeepEqual(index, tt.index) {
+				t.Logf("Expected %v, got %v: [%s] on [%q]", tt.index, index, tt.pattern, input)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestSubmatch(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		input      string
+		submatches []string
+
+		// bounds from FindSubmatchIndex, checked when set, for groups that
+		// capture nothing
+		index []int
+	}{
+		{pattern: `(\d+)-(\d+)`, input: "tel 555-0100", submatches: []string{"555-0100", "555", "0100"}},
+		{pattern: `(a)|(b)`, input: "b", submatches: []string{"b", "", "b"}},
+		{pattern: `(a|b)+`, input: "xabba", submatches: []string{"abba", "a"}},
+		{pattern: `((a)(b))?c`, input: "c", submatches: []string{"c", "", "", ""}},
+		{pattern: `(?:x(y))z`, input: "xyz", submatches: []string{"xyz", "y"}},
+		{pattern: `(?P<status>\d+) (?P<size>\d+)`, input: "GET / 200 512", submatches: []string{"200 512", "200", "512"}},
+		{pattern: `(a)`, input: "b", submatches: nil},
+
+		// greedy and lazy repeats
+		{pattern: `"(.*)"`, input: `say "hi" and "bye"`, submatches: []string{`"hi" and "bye"`, `hi" and "bye`}},
+		{pattern: `"(.*?)"`, input: `say "hi" and "bye"`, submatches: []string{`"hi"`, "hi"}},
+		{pattern: `(a+)(a*)`, input: "aaa", submatches: []string{"aaa", "aaa", ""}},
+		{pattern: `(a+?)(a*)`, input: "aaa", submatches: []string{"aaa", "a", "aa"}},
+		{pattern: `(a?)(a*)`, input: "aa", submatches: []string{"aa", "a", "a"}},
+		{pattern: `(a??)(a*)`, input: "aa", submatches: []string{"aa", "", "aa"}},
+		{pattern: `(a{2,4})(a*)`, input: "aaaaa", submatches: []string{"aaaaa", "aaaa", "a"}},
+		{pattern: `(a{2,4}?)(a*)`, input: "aaaaa", submatches: []string{"aaaaa", "aa", "aaa"}},
+		{pattern: `<.+?>`, input: "<b>bold</b>", submatches: []string{"<b>"}},
+		{pattern: `a*?`, input: "aaa", submatches: []string{""}},
+		{pattern: `(?>(a+))b`, input: "aab", submatches: []string{"aab", "aa"}},
+		{pattern: `(?>(a)|b)+c`, input: "abac", submatches: []string{"abac", "a"}},
+		{pattern: `(?=(\w+))\w`, input: "abc", submatches: []string{"a", "abc"}},
+		{pattern: `(?!(a))\w`, input: "ab", submatches: []string{"b", ""}},
+		{pattern: `<(\w+)>.*</\1>`, input: "<b><i>x</i></b>", submatches: []string{"<b><i>x</i></b>", "b"}},
+		{pattern: `(a+)+\1`, input: "aaaa", submatches: []string{"aaaa", "a"}},
+
+		// (?U) swaps greedy and lazy repeats
+		{pattern: `(?U)(a+)(a*)`, input: "aaa", submatches: []string{"a", "a", ""}},
+		{pattern: `(?U)(a+?)(a*)`, input: "aaa", submatches: []string{"aaa", "aaa", ""}},
+		{pattern: `(?U:(a+))(a+)`, input: "aaa", submatches: []string{"aaa", "a", "aa"}},
+
+		// captures made inside a subroutine call are discarded when it returns
+		{pattern: `(a|b)(?1)`, input: "ab", submatches: []string{"ab", "a"}},
+
+		// an iteration that matches nothing still captures, then ends the repeat
+		{pattern: `(|a)*`, input: "aa", submatches: []string{"", ""}, index: []int{0, 0, 0, 0}},
+		{pattern: `(a*)*`, input: "b", submatches: []string{"", ""}, index: []int{0, 0, 0, 0}},
+		{pattern: `(a*)*`, input: "aa", submatches: []string{"aa", ""}, index: []int{0, 2, 2, 2}},
+		{pattern: `(a|)*b`, input: "aab", submatches: []string{"aab", ""}, index: []int{0, 3, 2, 2}},
+		{pattern: `(a*?)*?b`, input: "aab", submatches: []string{"aab", "a"}, index: []int{0, 3, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s] on [%s]", tt.pattern, tt.input), func(t *testing.T) {
+			r, err := regex.Compile(tt.pattern)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			if submatches := r.FindStringSubmatch(tt.input); !reflect.DeepEqual(submatches, tt.submatches) {
+				t.Logf("Expected %q, got %q: [%s] on [%s]", tt.submatches, submatches, tt.pattern, tt.input)
+				t.Fail()
+			}
+
+			if index := r.FindSubmatchIndex(tt.input); tt.index != nil && !reflect.DeepEqual(index, tt.index) {
+				t.Logf("Expected %v, got %v: [%s] on [%s]", tt.index, index, tt.pattern, tt.input)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestLongInput(t *testing.T) {
+	input := strings.Repeat("ab", 500000)
+
+	tests := []struct {
+		pattern string
+		match   bool
+	}{
+		{pattern: ".*", match: true},
+		{pattern: `(a)(b)(?:\1\2)*`, match: true},
+		{pattern: "(?:ab)*a", match: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s]", tt.pattern), func(t *testing.T) {
+			r, err := regex.Compile(tt.pattern)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			if actual := r.Match(input); actual != tt.match {
+				t.Logf("Expected %t, got %t on %d bytes", tt.match, actual, len(input))
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestLongSearch(t *testing.T) {
+	// each of these fails from every start, which must not take quadratic
+	// time or worse
+	tests := []struct {
+		pattern string
+		input   string
+	}{
+		{pattern: `a*+b`, input: strings.Repeat("a", 20000)},
+		{pattern: `(?>a*)b`, input: strings.Repeat("a", 20000)},
+		{pattern: `(?=.*x)a`, input: strings.Repeat("a", 20000)},
+		{pattern: `(?!a*$)a`, input: strings.Repeat("a", 20000)},
+		{pattern: `\((?:[^()]|(?R))*\)`, input: strings.Repeat("(", 3000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Test for: [%s] on %d bytes", tt.pattern, len(tt.input)), func(t *testing.T) {
+			r, err := regex.Compile(tt.pattern)
+			if err != nil {
+				t.Fatalf("Unexpected error for [%s]: %v", tt.pattern, err)
+			}
+
+			start := time.Now()
+
+			if r.Search(tt.input) {
+				t.Logf("Expected no match: [%s] on %d bytes", tt.pattern, len(tt.input))
+				t.Fail()
+			}
+
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Logf("Expected the search to be quick, took %v: [%s] on %d bytes", elapsed, tt.pattern, len(tt.input))
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestRecursionDepth(t *testing.T) {
+	r, err := regex.Compile(`(a(?1)?b)`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	nested := func(depth int) string {
+		return strings.Repeat("a", depth) + strings.Repeat("b", depth)
+	}
+
+	if !r.Match(nested(fsm.MAX_CALL_DEPTH)) {
+		t.Logf("Expected a match %d calls deep", fsm.MAX_CALL_DEPTH)
+		t.Fail()
+	}
+
+	if r.Match(nested(fsm.MAX_CALL_DEPTH + 2)) {
+		t.Logf("Expected no match past %d calls deep", fsm.MAX_CALL_DEPTH)
+		t.Fail()
+	}
+}
+
+func TestSubexpNames(t *testing.T) {
+	r, err := regex.Compile(`(?P<method>[A-Z]+) (\S+) (?<status>\d+)`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if names := r.SubexpNames(); !reflect.DeepEqual(names, []string{"", "method", "", "status"}) {
+		t.Logf("Unexpected names %q", names)
+		t.Fail()
+	}
+
+	if r.NumSubexp() != 3 {
+		t.Logf("Expected 3 groups, got %d", r.NumSubexp())
+		t.Fail()
+	}
+
+	submatches := r.FindStringSubmatch("GET /index.html 404")
+
+	if status := submatches[r.SubexpIndex("status")]; status != "404" {
+		t.Logf("Expected status 404, got %q", status)
+		t.Fail()
+	}
+
+	if method := submatches[r.SubexpIndex("method")]; method != "GET" {
+		t.Logf("Expected method GET, got %q", method)
+		t.Fail()
+	}
+
+	if idx := r.SubexpIndex("missing"); idx != -1 {
+		t.Logf("Expected -1 for an unknown name, got %d", idx)
+		t.Fail()
 	}
 }